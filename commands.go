@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/medvedev/wsd/wsd"
+)
+
+// closeRequest asks runSession to close the connection with the given status.
+type closeRequest struct {
+	code   int
+	reason string
+}
+
+// userClose is how we close the connection when the user is done with it:
+// with the -closeCode and -closeReason.
+func userClose() closeRequest {
+	return closeRequest{code: closeCode, reason: closeReason}
+}
+
+// validCloseCode reports whether we may send code in a close frame: the
+// codes defined by RFC 6455 that aren't reserved for reporting, or the
+// codes of applications.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 3000 && code <= 4999:
+		return true
+	case code == 1004 || code == 1005 || code == 1006:
+		return false
+	}
+	return code >= 1000 && code <= 1014
+}
+
+var commandHelp = []struct{ usage, description string }{
+	{"ping [payload]", "send a ping frame"},
+	{"send count message", "send the message count times in a row"},
+	{"close [code] [reason]", "close the connection with the given status (default -closeCode)"},
+	{"quit", "close the connection and exit"},
+	{"binary", "send the next messages as binary frames"},
+	{"text", "send the next messages as text frames"},
+	{"help", "list the commands"},
+}
+
+// sendBurst sends msg n times as fast as we can, reporting how many were
+// sent should the connection fail along the way.
+func sendBurst(client *wsd.Client, n int, line []byte) {
+	for i := 0; i < n; i++ {
+		msg, err := newMessage(line)
+		if err == nil {
+			err = sendTranscribed(client, msg)
+		}
+		if err != nil {
+			printError(fmt.Errorf("sent %d of %d messages: %w", i, n, err))
+			return
+		}
+		stats.countSent(msg)
+		printSentMessage(msg)
+	}
+}
+
+// isCommand reports whether line is a command rather than a message to send.
+func isCommand(line []byte) bool {
+	return cmdPrefix != "" && strings.HasPrefix(string(line), cmdPrefix)
+}
+
+// runCommand executes a command typed by the user, returning a closeRequest
+// when it requires the connection to be closed.
+func runCommand(client *wsd.Client, line string) *closeRequest {
+	name, args, _ := strings.Cut(strings.TrimPrefix(line, cmdPrefix), " ")
+	args = strings.TrimSpace(args)
+
+	switch name {
+	case "ping":
+		if err := client.Ping([]byte(args)); err != nil {
+			printError(err)
+			return nil
+		}
+	case "send":
+		count, msg, _ := strings.Cut(args, " ")
+		n, err := strconv.Atoi(count)
+		if err != nil || n <= 0 {
+			printError(fmt.Errorf("invalid count %q", count))
+			return nil
+		}
+		sendBurst(client, n, []byte(msg))
+	case "close":
+		request := userClose()
+		if args != "" {
+			code, reason, _ := strings.Cut(args, " ")
+			var err error
+			if request.code, err = strconv.Atoi(code); err != nil || !validCloseCode(request.code) {
+				printError(fmt.Errorf("invalid close code %q", code))
+				return nil
+			}
+			request.reason = strings.TrimSpace(reason)
+		}
+		return &request
+	case "quit":
+		request := userClose()
+		return &request
+	case "binary":
+		sendBinary.Store(true)
+		updatePrompt()
+	case "text":
+		sendBinary.Store(false)
+		updatePrompt()
+	case "help":
+		for _, command := range commandHelp {
+			fmt.Fprintf(stdout, "\r%-24s %s\n", cmdPrefix+command.usage, command.description)
+		}
+	default:
+		printError(fmt.Errorf("unknown command %s, try %shelp", cmdPrefix+name, cmdPrefix))
+		return nil
+	}
+	printPrompt()
+	return nil
+}
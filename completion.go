@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// shells are the shells -completion generates scripts for.
+var shells = map[string]func(w io.Writer){
+	"bash": bashCompletion,
+	"zsh":  zshCompletion,
+	"fish": fishCompletion,
+}
+
+// hiddenFlags are left out of the usage and of the completions.
+var hiddenFlags = map[string]bool{"completion": true}
+
+// printDefaults is flag.PrintDefaults without the hidden flags.
+func printDefaults() {
+	visible := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	visible.SetOutput(flag.CommandLine.Output())
+	visibleFlags(func(f *flag.Flag) {
+		visible.Var(f.Value, f.Name, f.Usage)
+		// Rather than the value given on the command line.
+		visible.Lookup(f.Name).DefValue = f.DefValue
+	})
+	visible.PrintDefaults()
+}
+
+func visibleFlags(fn func(f *flag.Flag)) {
+	flag.VisitAll(func(f *flag.Flag) {
+		if !hiddenFlags[f.Name] {
+			fn(f)
+		}
+	})
+}
+
+// flagValues returns the values completed for the flag of the given name,
+// nil for flags taking arbitrary values.
+func flagValues(name string) []string {
+	var values []string
+	switch name {
+	case "color":
+		values = colorModes
+	case "minTLS":
+		for _, v := range tlsVersions {
+			values = append(values, v.name)
+		}
+	}
+	return values
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// flagSummary is the first line of the usage of f.
+func flagSummary(f *flag.Flag) string {
+	summary, _, _ := strings.Cut(f.Usage, "\n")
+	return summary
+}
+
+func bashCompletion(w io.Writer) {
+	fmt.Fprintln(w, "_wsd() {")
+	fmt.Fprintln(w, `	local cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}`)
+	fmt.Fprintln(w, "	case $prev in")
+	var names []string
+	visibleFlags(func(f *flag.Flag) {
+		names = append(names, "-"+f.Name)
+		if values := flagValues(f.Name); values != nil {
+			fmt.Fprintf(w, "	-%s) COMPREPLY=($(compgen -W %q -- \"$cur\")); return ;;\n", f.Name, strings.Join(values, " "))
+		}
+	})
+	fmt.Fprintln(w, "	esac")
+	fmt.Fprintln(w, "	if [[ $cur == -* ]]; then")
+	fmt.Fprintf(w, "		COMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(names, " "))
+	fmt.Fprintln(w, "	fi")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "complete -o default -F _wsd wsd")
+}
+
+func zshCompletion(w io.Writer) {
+	escape := strings.NewReplacer(`'`, `'\''`, `[`, `\[`, `]`, `\]`, `:`, `\:`)
+
+	fmt.Fprintln(w, "#compdef wsd")
+	fmt.Fprintln(w, "_arguments \\")
+	visibleFlags(func(f *flag.Flag) {
+		spec := fmt.Sprintf("-%s[%s]", f.Name, escape.Replace(flagSummary(f)))
+		switch values := flagValues(f.Name); {
+		case isBoolFlag(f):
+		case values != nil:
+			spec += fmt.Sprintf(":%s:(%s)", f.Name, strings.Join(values, " "))
+		default:
+			spec += ":" + f.Name + ":_default"
+		}
+		fmt.Fprintf(w, "\t'%s' \\\n", spec)
+	})
+	fmt.Fprintln(w, "\t':url:'")
+}
+
+func fishCompletion(w io.Writer) {
+	escape := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+	visibleFlags(func(f *flag.Flag) {
+		spec := fmt.Sprintf("complete -c wsd -o %s", f.Name)
+		switch values := flagValues(f.Name); {
+		case isBoolFlag(f):
+		case values != nil:
+			spec += fmt.Sprintf(" -x -a '%s'", strings.Join(values, " "))
+		default:
+			spec += " -r"
+		}
+		fmt.Fprintf(w, "%s -d '%s'\n", spec, escape.Replace(flagSummary(f)))
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/cookiejar"
+	urlpkg "net/url"
+	"os"
+	"strings"
+)
+
+// jar keeps the cookies of the server across reconnections and redirections.
+var jar, _ = cookiejar.New(nil)
+
+// cookieFlag collects the cookies given through repeated -cookie flags.
+type cookieFlag []*http.Cookie
+
+func (c *cookieFlag) String() string {
+	var pairs []string
+	for _, cookie := range *c {
+		pairs = append(pairs, cookie.Name+"="+cookie.Value)
+	}
+	return strings.Join(pairs, "; ")
+}
+
+func (c *cookieFlag) Set(value string) error {
+	cookie, err := parseCookie(value)
+	if err != nil {
+		return err
+	}
+	*c = append(*c, cookie)
+	return nil
+}
+
+func parseCookie(pair string) (*http.Cookie, error) {
+	name, value, ok := strings.Cut(pair, "=")
+	if name = strings.TrimSpace(name); !ok || name == "" {
+		return nil, fmt.Errorf("expected \"name=value\", got %q", pair)
+	}
+	// For every path of the server.
+	return &http.Cookie{Name: name, Value: strings.TrimSpace(value), Path: "/"}, nil
+}
+
+// cookieURL is the URL the cookies of the server at location are kept for,
+// the jar only knowing of http:// and https://.
+func cookieURL(location string) (*urlpkg.URL, error) {
+	u, err := urlpkg.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	return u, nil
+}
+
+// seedJar puts the -cookie and the cookies of the -cookieFile in the jar,
+// the file being created on exit if it doesn't exist yet.
+func seedJar() error {
+	u, err := cookieURL(url)
+	if err != nil {
+		return err
+	}
+
+	cookies := cookies
+	if cookieFile != "" {
+		saved, err := readCookieFile(cookieFile)
+		if err != nil {
+			return fmt.Errorf("-cookieFile: %w", err)
+		}
+		// The -cookie flags take precedence.
+		cookies = append(saved, cookies...)
+	}
+	jar.SetCookies(u, cookies)
+	return nil
+}
+
+// readCookieFile reads the cookies of the file name, one name=value pair
+// per line.
+func readCookieFile(name string) ([]*http.Cookie, error) {
+	file, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var cookies []*http.Cookie
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		cookie, err := parseCookie(line)
+		if err != nil {
+			return nil, err
+		}
+		cookies = append(cookies, cookie)
+	}
+	return cookies, scanner.Err()
+}
+
+// saveCookies writes the cookies the jar holds for the server at location
+// to the -cookieFile.
+func saveCookies(location string) {
+	u, err := cookieURL(location)
+	if err != nil {
+		printError(err)
+		return
+	}
+
+	var content strings.Builder
+	for _, cookie := range jar.Cookies(u) {
+		fmt.Fprintf(&content, "%s=%s\n", cookie.Name, cookie.Value)
+	}
+	if err := os.WriteFile(cookieFile, []byte(content.String()), 0o600); err != nil {
+		printError(fmt.Errorf("-cookieFile: %w", err))
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	urlpkg "net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
+
+	"github.com/medvedev/wsd/wsd"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// errInterrupted is returned by redial when ctx is done.
+var errInterrupted = errors.New("interrupted")
+
+// redial tries to connect again, waiting an exponentially growing and
+// randomized delay between attempts.
+func redial(ctx context.Context) (*wsd.Client, error) {
+	delay := minReconnectDelay
+	for attempt := 1; maxRetries == 0 || attempt <= maxRetries; attempt++ {
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+		if !quiet {
+			fmt.Fprintf(stderr, "\r%s\n", faint(fmt.Sprintf("reconnecting in %v (attempt %d)...", wait.Round(time.Millisecond), attempt)))
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, errInterrupted
+		}
+
+		client, err := connect(ctx)
+		if err == nil {
+			return client, nil
+		}
+		if ctx.Err() != nil {
+			return nil, errInterrupted
+		}
+		fmt.Fprintf(stderr, "%s\n", faint("reconnection failed: "+describeDialError(err)))
+
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+	return nil, fmt.Errorf("giving up after %d attempts", maxRetries)
+}
+
+// dialCount counts the successful connections, numbering them for
+// -connectionIDs.
+var dialCount atomic.Int64
+
+// connect connects to the server as configured by the flags.
+func connect(ctx context.Context) (*wsd.Client, error) {
+	config, err := clientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	client := wsd.NewClient(config)
+	err = client.Connect(ctx)
+	if verbose {
+		logHandshake(client)
+	}
+	if timing {
+		printTiming(client.Timing())
+	}
+	if resp := client.Response(); err == wsd.ErrBadStatus && !followRedirects && resp.StatusCode/100 == 3 {
+		return nil, fmt.Errorf("server redirected the handshake to %s, which -followRedirects follows", resp.Header.Get("Location"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	dialCount.Add(1)
+	return client, nil
+}
+
+// parseBind parses the -bind address, whose port is optional.
+func parseBind(bind string) (*net.TCPAddr, error) {
+	host, port, err := net.SplitHostPort(bind)
+	if err != nil {
+		host, port = bind, "0"
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if ip == nil {
+		return nil, fmt.Errorf("%q isn't an IP address", host)
+	}
+	portNumber, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(portNumber)}, nil
+}
+
+// readTokenFile reads the token of the -tokenFile, without the trailing
+// newline.
+func readTokenFile(name string) (string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimRightFunc(string(data), unicode.IsSpace)
+	if token == "" {
+		return "", fmt.Errorf("%s is empty", name)
+	}
+	return token, nil
+}
+
+// printDryRun prints the handshake request connect would send, returning
+// the exit status of the program.
+func printDryRun() int {
+	config, err := clientConfig()
+	if err == nil {
+		var req *http.Request
+		if req, err = wsd.NewClient(config).HandshakeRequest(); err == nil {
+			printRequest(req)
+			return 0
+		}
+	}
+	fmt.Fprintln(os.Stderr, red(err))
+	return 1
+}
+
+func clientConfig() (wsd.Config, error) {
+	config := wsd.Config{
+		URL:            url,
+		Origin:         origin,
+		Header:         http.Header{},
+		PingInterval:   pingInterval,
+		PingPayload:    []byte(pingPayload),
+		IgnorePings:    !autoPong,
+		IdleTimeout:    idleTimeout,
+		Compression:    compress,
+		MaxMessageSize: maxMessageSize,
+		OnRedirect:     logRedirect,
+		Jar:            jar,
+		LocalAddr:      localAddr,
+		Nagle:          !noDelay,
+		TCPKeepAlive:   tcpKeepAlive,
+		Resolve:        resolve,
+	}
+	if verbose {
+		config.OnPing = logPing
+	}
+	if verbose || latencyInterval > 0 && latencyEcho == "" {
+		config.OnPong = func(payload []byte) {
+			if verbose {
+				logPong(payload)
+			}
+			if latencyInterval > 0 && latencyEcho == "" {
+				latency.answer(payload)
+			}
+		}
+	}
+	for _, p := range strings.Split(protocol, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			config.Protocols = append(config.Protocols, p)
+		}
+	}
+	// The default gives way to a User-Agent given with -header.
+	if _, ok := headers["User-Agent"]; userAgent != "" && (isFlagSet("userAgent") || !ok) {
+		config.Header.Add("User-Agent", userAgent)
+	}
+	for key, values := range headers {
+		for _, value := range values {
+			config.Header.Add(key, value)
+		}
+	}
+	if tokenFile != "" {
+		bearer, err := readTokenFile(tokenFile)
+		if err != nil {
+			return config, fmt.Errorf("-tokenFile: %w", err)
+		}
+		config.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	if token != "" {
+		config.Header.Set("Authorization", "Bearer "+token)
+	}
+	if basicAuth != "" {
+		config.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(basicAuth)))
+	}
+
+	if followRedirects {
+		config.MaxRedirects = maxRedirects
+	}
+	if tcpKeepAlive == 0 {
+		config.TCPKeepAlive = -1
+	}
+
+	var err error
+	if unixSocket != "" {
+		config.UnixSocket = unixSocket
+	} else if config.Proxy, err = proxyURL(); err != nil {
+		return config, err
+	}
+	config.TLSConfig, err = tlsConfig()
+	return config, err
+}
+
+// proxyURL returns the -proxy or the -socks5 proxy, falling back to the
+// HTTP_PROXY or HTTPS_PROXY environment variables depending on the scheme of
+// the -url, then to ALL_PROXY.
+func proxyURL() (*urlpkg.URL, error) {
+	switch {
+	case proxy != "":
+		return urlpkg.Parse(proxy)
+	case socks5 != "":
+		return urlpkg.Parse("socks5://" + socks5)
+	}
+
+	location, err := urlpkg.Parse(url)
+	if err != nil {
+		return nil, err
+	}
+	switch location.Scheme {
+	case "ws":
+		location.Scheme = "http"
+	case "wss":
+		location.Scheme = "https"
+	}
+
+	env := httpproxy.FromEnvironment()
+	if all := getenvAny("ALL_PROXY", "all_proxy"); all != "" {
+		if env.HTTPProxy == "" {
+			env.HTTPProxy = all
+		}
+		if env.HTTPSProxy == "" {
+			env.HTTPSProxy = all
+		}
+	}
+	return env.ProxyFunc()(location)
+}
+
+// getenvAny returns the value of the first of the environment variables
+// that is set.
+func getenvAny(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: insecureSkipVerify,
+		ServerName:         serverName,
+		MinVersion:         minTLSVersion,
+	}
+	for _, p := range strings.Split(alpn, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			config.NextProtos = append(config.NextProtos, p)
+		}
+	}
+
+	if pinnedFingerprint != nil {
+		// The pin replaces the verification of the certificate chain.
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = verifyPin
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if caCertFile != "" || caPathCerts != nil {
+		config.RootCAs = x509.NewCertPool()
+		for _, cert := range caPathCerts {
+			config.RootCAs.AddCert(cert)
+		}
+	}
+	if caCertFile != "" {
+		bundle, err := os.ReadFile(caCertFile)
+		if err != nil {
+			return nil, err
+		}
+		if !config.RootCAs.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no PEM certificate found in %s", caCertFile)
+		}
+	}
+
+	return config, nil
+}
+
+// loadCAPath returns the certificates of the .pem and .crt files of dir,
+// warning about the files it can't read them from.
+func loadCAPath(dir string) ([]*x509.Certificate, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for _, entry := range entries {
+		if ext := filepath.Ext(entry.Name()); entry.IsDir() || ext != ".pem" && ext != ".crt" {
+			continue
+		}
+		name := filepath.Join(dir, entry.Name())
+		found, err := readCertificates(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", yellow(fmt.Sprintf("-capath: skipping %s: %v", name, err)))
+			continue
+		}
+		certs = append(certs, found...)
+	}
+	if certs == nil {
+		return nil, fmt.Errorf("no PEM certificate found in %s", dir)
+	}
+	return certs, nil
+}
+
+// readCertificates parses the PEM certificates of the file name.
+func readCertificates(name string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if certs == nil {
+		return nil, errors.New("no PEM certificate found")
+	}
+	return certs, nil
+}
+
+// errPinMismatch rejects servers whose certificate doesn't match the -pin.
+var errPinMismatch = errors.New("certificate doesn't match the -pin")
+
+func verifyPin(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errPinMismatch
+	}
+	fingerprint := sha256.Sum256(rawCerts[0])
+	if !bytes.Equal(fingerprint[:], pinnedFingerprint) {
+		return fmt.Errorf("%w, its fingerprint is %s", errPinMismatch, formatFingerprint(fingerprint))
+	}
+	return nil
+}
+
+// tlsVersions are the TLS versions accepted by -minTLS.
+var tlsVersions = []struct {
+	name    string
+	version uint16
+}{
+	{"1.0", tls.VersionTLS10},
+	{"1.1", tls.VersionTLS11},
+	{"1.2", tls.VersionTLS12},
+	{"1.3", tls.VersionTLS13},
+}
+
+func parseTLSVersion(name string) (uint16, error) {
+	names := make([]string, len(tlsVersions))
+	for i, v := range tlsVersions {
+		if v.name == name {
+			return v.version, nil
+		}
+		names[i] = v.name
+	}
+	return 0, fmt.Errorf("unknown TLS version %q, expected one of %s", name, strings.Join(names, ", "))
+}
+
+// describeDialError explains in a few words why connect failed, recognizing the
+// most common causes.
+func describeDialError(err error) string {
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || isTimeout(err):
+		if timeout > 0 {
+			return fmt.Sprintf("connection timed out after %v", timeout)
+		}
+		return "connection timed out"
+	case errors.Is(err, context.Canceled):
+		return "interrupted"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case bind != "" && (errors.Is(err, syscall.EADDRNOTAVAIL) || errors.Is(err, syscall.EADDRINUSE)):
+		return fmt.Sprintf("could not bind to %s: %v", bind, err)
+	case errors.As(err, &dnsErr):
+		return fmt.Sprintf("could not resolve host %s", dnsErr.Name)
+	case errors.As(err, &certErr):
+		return fmt.Sprintf("TLS handshake failed: %v", certErr.Err)
+	case errors.Is(err, errPinMismatch):
+		return fmt.Sprintf("TLS handshake failed: %v", err)
+	case errors.As(err, &recordErr):
+		return "TLS handshake failed: server did not answer with TLS"
+	case err == wsd.ErrBadStatus:
+		return "server refused the WebSocket upgrade"
+	}
+	return err.Error()
+}
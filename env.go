@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envFlags are the flags defaulting to an environment variable, which the
+// flags given on the command line override.
+var envFlags = []struct{ flag, env string }{
+	{"url", "WSD_URL"},
+	{"origin", "WSD_ORIGIN"},
+	{"token", "WSD_TOKEN"},
+	{"header", "WSD_HEADER"},
+}
+
+// applyEnvironment sets the envFlags not given on the command line to the
+// value of their environment variable, if set. WSD_HEADER holds headers
+// separated by semicolons.
+func applyEnvironment() error {
+	for _, f := range envFlags {
+		value, ok := os.LookupEnv(f.env)
+		// The URL argument counts as giving -url.
+		if !ok || isFlagSet(f.flag) || f.flag == "url" && urlArg != "" {
+			continue
+		}
+
+		values := []string{value}
+		if f.flag == "header" {
+			values = nil
+			for _, header := range strings.Split(value, ";") {
+				if header = strings.TrimSpace(header); header != "" {
+					values = append(values, header)
+				}
+			}
+		}
+		for _, value := range values {
+			if err := flag.Set(f.flag, value); err != nil {
+				return fmt.Errorf("%s: %w", f.env, err)
+			}
+		}
+	}
+	return nil
+}
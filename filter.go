@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/medvedev/wsd/wsd"
+)
+
+// matches reports whether msg passes the -grep and -grepv filters.
+func matches(msg wsd.Message) bool {
+	if grepPattern != nil && !grepPattern.Match(msg.Data) {
+		return false
+	}
+	return grepvPattern == nil || !grepvPattern.Match(msg.Data)
+}
+
+// highlight colors text like formatText does, with the matches of the
+// -grep standing out.
+func highlight(text string) string {
+	var out strings.Builder
+	last := 0
+	for _, match := range grepPattern.FindAllStringIndex(text, -1) {
+		if match[0] == match[1] {
+			continue
+		}
+		out.WriteString(cyan(text[last:match[0]]))
+		out.WriteString(red(text[match[0]:match[1]]))
+		last = match[1]
+	}
+	out.WriteString(cyan(text[last:]))
+	return out.String()
+}
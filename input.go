@@ -0,0 +1,201 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"unicode"
+
+	"github.com/chzyer/readline"
+	"github.com/medvedev/wsd/wsd"
+)
+
+// editor edits the lines typed in a terminal, nil when stdin isn't one.
+var editor *readline.Instance
+
+// editorStdin is the stdin of the editor, which we cancel ourselves: closing
+// the editor leaves it be, and waits for the read it is blocked in.
+var editorStdin *readline.CancelableStdin
+
+// stdout and stderr are where the output of the session goes, through the
+// editor when there is one so that the line being typed survives it.
+var (
+	stdout io.Writer = os.Stdout
+	stderr io.Writer = os.Stderr
+)
+
+// historyLimit is the number of lines kept in the history file.
+const historyLimit = 1000
+
+// defaultHistoryFile is where the lines typed are saved without -historyFile,
+// per the XDG base directory specification.
+func defaultHistoryFile() (string, error) {
+	dir := os.Getenv("XDG_DATA_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(dir, "wsd", "history"), nil
+}
+
+// openEditor sets up the line editor, which manages the prompt and keeps the
+// history of the lines typed, saved across sessions unless -noHistory.
+func openEditor() error {
+	config := &readline.Config{
+		Prompt:       prompt(),
+		HistoryLimit: historyLimit,
+		// For saveHistory to leave out the repeated lines.
+		DisableAutoSaveHistory: true,
+	}
+	editorStdin = readline.NewCancelableStdin(os.Stdin)
+	config.Stdin = editorStdin
+	if !noHistory {
+		name := historyFile
+		if name == "" {
+			var err error
+			if name, err = defaultHistoryFile(); err != nil {
+				return err
+			}
+		}
+		// It may hold the secrets typed.
+		if err := os.MkdirAll(filepath.Dir(name), 0o700); err != nil {
+			return err
+		}
+		config.HistoryFile = name
+		lastSaved = lastHistoryLine(name)
+	}
+
+	var err error
+	if editor, err = readline.NewEx(config); err != nil {
+		return err
+	}
+	stdout, stderr = editor.Stdout(), editor.Stderr()
+	return nil
+}
+
+// closeEditor restores the terminal, cancelling the line being read.
+func closeEditor() {
+	editorStdin.Close()
+	editor.Close()
+}
+
+// prompt is the prompt of the editor, depending on whether a heredoc is
+// being typed and on the type of the messages sent.
+func prompt() string {
+	switch {
+	case quiet:
+		return ""
+	case doc.continued():
+		return "... "
+	case hexInput || sendType() == wsd.BinaryMessage:
+		return "bin> "
+	}
+	return "text> "
+}
+
+// readTerminal sends the lines typed to out until the user hits Ctrl-D,
+// calling interrupt if they hit Ctrl-C on an empty line. Ctrl-C cancels the
+// heredoc being typed, if any.
+func readTerminal(out chan<- inputLine, interrupt func()) {
+	defer close(out)
+
+	for {
+		line, err := editor.Readline()
+		switch {
+		case err == readline.ErrInterrupt:
+			if doc.open() {
+				doc.cancel()
+				editor.SetPrompt(prompt())
+			} else if line == "" {
+				interrupt()
+				return
+			}
+		case err != nil:
+			return
+		default:
+			saveHistory(line)
+			if msg, ok := doc.add(line); ok {
+				out <- inputLine{data: msg}
+			}
+			editor.SetPrompt(prompt())
+		}
+	}
+}
+
+// lastSaved is the last line saved to the history.
+var lastSaved string
+
+// lastHistoryLine returns the last line of the history file name, for
+// saveHistory not to repeat it in the next session.
+func lastHistoryLine(name string) string {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return ""
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	return lines[len(lines)-1]
+}
+
+// saveHistory adds line to the history, unless it is empty or the same as
+// the previous one.
+func saveHistory(line string) {
+	if strings.TrimSpace(line) == "" || line == lastSaved {
+		return
+	}
+	lastSaved = line
+	editor.SaveHistory(line)
+}
+
+// doc is the heredoc being typed on stdin.
+var doc heredoc
+
+// heredoc accumulates the lines of a multi-line message, started by a line
+// like <<END and ended by a line equal to END.
+type heredoc struct {
+	tag   string
+	lines []string
+	// typing mirrors open for the prompt, which other goroutines than the
+	// one reading the input show.
+	typing atomic.Bool
+}
+
+// add adds line to the heredoc, returning the message to send if line
+// completes one or isn't part of one.
+func (h *heredoc) add(line string) ([]byte, bool) {
+	if !h.open() {
+		tag, found := strings.CutPrefix(line, "<<")
+		if !found || noHeredoc || tag == "" || strings.IndexFunc(tag, unicode.IsSpace) >= 0 {
+			return []byte(line), true
+		}
+		h.tag = tag
+		h.typing.Store(true)
+		return nil, false
+	}
+
+	if line != h.tag {
+		h.lines = append(h.lines, line)
+		return nil, false
+	}
+	msg := []byte(strings.Join(h.lines, "\n"))
+	h.cancel()
+	return msg, true
+}
+
+func (h *heredoc) open() bool {
+	return h.tag != ""
+}
+
+func (h *heredoc) cancel() {
+	h.tag, h.lines = "", nil
+	h.typing.Store(false)
+}
+
+// continued reports whether a heredoc is being typed, from any goroutine.
+func (h *heredoc) continued() bool {
+	return h.typing.Load()
+}
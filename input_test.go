@@ -0,0 +1,150 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/sys/unix"
+)
+
+func TestMain(m *testing.M) {
+	// Run as wsd by the tests executing the test binary.
+	if os.Getenv("WSD_TEST_MAIN") == "1" {
+		os.Args = append(os.Args[:1], strings.Fields(os.Getenv("WSD_TEST_ARGS"))...)
+		main()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// openPTY opens a pseudo-terminal, returning its master and slave ends.
+func openPTY(t *testing.T) (master, slave *os.File) {
+	t.Helper()
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		t.Skipf("no pseudo-terminal: %v", err)
+	}
+	t.Cleanup(func() { master.Close() })
+	fd := int(master.Fd())
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		t.Fatal(err)
+	}
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slave, err = os.OpenFile("/dev/pts/"+strconv.Itoa(n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { slave.Close() })
+	return master, slave
+}
+
+func echoServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(messageType, data)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestTerminalSessionExits(t *testing.T) {
+	server := echoServer(t)
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"quit", "/quit\r"},
+		{"interrupt", "\x03"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			master, slave := openPTY(t)
+			cmd := exec.Command(os.Args[0])
+			cmd.Env = append(os.Environ(), "WSD_TEST_MAIN=1", "WSD_TEST_ARGS=-noHistory "+url)
+			cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+			cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { cmd.Process.Kill() })
+
+			exited := make(chan error, 1)
+			go func() { exited <- cmd.Wait() }()
+
+			prompted := make(chan struct{})
+			go func() {
+				reader := bufio.NewReader(master)
+				var seen strings.Builder
+				for !strings.Contains(seen.String(), "text> ") {
+					b, err := reader.ReadByte()
+					if err != nil {
+						return
+					}
+					seen.WriteByte(b)
+				}
+				close(prompted)
+				// Keep draining, lest the output fill up the terminal.
+				reader.WriteTo(io.Discard)
+			}()
+			select {
+			case <-prompted:
+			case err := <-exited:
+				t.Fatalf("exited with %v before prompting", err)
+			case <-time.After(5 * time.Second):
+				t.Fatal("no prompt")
+			}
+			master.WriteString(tt.input)
+
+			select {
+			case err := <-exited:
+				if err != nil {
+					t.Fatalf("exited with %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("still running after %q", tt.input)
+			}
+		})
+	}
+}
+
+func TestLastHistoryLine(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "history")
+	if got := lastHistoryLine(name); got != "" {
+		t.Errorf("lastHistoryLine() = %q without a history file, want none", got)
+	}
+	if err := os.WriteFile(name, []byte("/ping\nhello\n\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got := lastHistoryLine(name); got != "hello" {
+		t.Errorf("lastHistoryLine() = %q, want %q", got, "hello")
+	}
+}
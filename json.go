@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+var blue = newColor(color.FgBlue)
+
+// jsonIndent is the indentation of the JSON messages, as given by the
+// -prettyIndent.
+var jsonIndent = "  "
+
+// parseIndent returns the indentation -prettyIndent stands for: a number of
+// spaces, or the indentation itself.
+func parseIndent(indent string) string {
+	if n, err := strconv.Atoi(indent); err == nil && n >= 0 {
+		return strings.Repeat(" ", n)
+	}
+	return string(unescape(indent))
+}
+
+// formatJSON indents and colors msg, or compacts it with -compactJSON,
+// reporting whether it was valid JSON.
+func formatJSON(msg []byte) (string, bool) {
+	var formatted bytes.Buffer
+	var err error
+	if compactJSON {
+		err = json.Compact(&formatted, msg)
+	} else {
+		err = json.Indent(&formatted, msg, "", jsonIndent)
+	}
+	if err != nil {
+		return "", false
+	}
+	return colorizeJSON(formatted.Bytes()), true
+}
+
+// colorizeJSON colors the keys, strings, numbers and literals of data, which
+// must be valid JSON as formatted by json.Indent or json.Compact.
+func colorizeJSON(data []byte) string {
+	var out strings.Builder
+
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch {
+		case c == '"':
+			end := i + 1
+			for data[end] != '"' {
+				if data[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end++
+
+			// json.Indent and json.Compact put the colon right after the key.
+			if end < len(data) && data[end] == ':' {
+				out.WriteString(blue(string(data[i:end])))
+			} else {
+				out.WriteString(green(string(data[i:end])))
+			}
+			i = end
+		case c == '-' || (c >= '0' && c <= '9'):
+			end := i + 1
+			for end < len(data) && strings.IndexByte("+-.eE0123456789", data[end]) >= 0 {
+				end++
+			}
+			out.WriteString(yellow(string(data[i:end])))
+			i = end
+		case c >= 'a' && c <= 'z':
+			end := i + 1
+			for end < len(data) && data[end] >= 'a' && data[end] <= 'z' {
+				end++
+			}
+			out.WriteString(magenta(string(data[i:end])))
+			i = end
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+
+	return out.String()
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/medvedev/wsd/wsd"
+)
+
+// latencyTag starts the payload of the pings sent to measure the latency,
+// followed by their sequence number and the time they were sent.
+const latencyTag = "wsd-latency"
+
+// latencyProbe keeps track of the probes sent with -latency and of the round
+// trip times measured, across reconnections.
+type latencyProbe struct {
+	mu       sync.Mutex
+	seq      uint64
+	last     uint64 // highest sequence number answered
+	pending  map[uint64]bool
+	samples  []time.Duration
+	late     int
+	repeated int
+}
+
+var latency = latencyProbe{pending: map[uint64]bool{}}
+
+// latencyLoop sends a probe every -latency, a ping or a -latencyEcho text
+// message, until ctx is done.
+func latencyLoop(ctx context.Context, client *wsd.Client) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(latencyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			payload := latency.next()
+			var err error
+			if latencyEcho != "" {
+				err = client.Send(wsd.Message{Type: wsd.TextMessage, Data: payload})
+			} else {
+				err = client.Ping(payload)
+			}
+			if err != nil {
+				printError(err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// next returns the payload of the next probe.
+func (p *latencyProbe) next() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.seq++
+	p.pending[p.seq] = true
+	tag := latencyTag
+	if latencyEcho != "" {
+		tag = latencyEcho
+	}
+	return []byte(fmt.Sprintf("%s %d %d", tag, p.seq, time.Now().UnixNano()))
+}
+
+// answer records the round trip time of the probe payload is the answer
+// of, reporting whether it is one.
+func (p *latencyProbe) answer(payload []byte) bool {
+	tag := latencyTag
+	if latencyEcho != "" {
+		tag = latencyEcho
+	}
+	fields := bytes.Fields(payload)
+	if len(fields) != 3 || string(fields[0]) != tag {
+		return false
+	}
+	seq, err := strconv.ParseUint(string(fields[1]), 10, 64)
+	if err != nil {
+		return false
+	}
+	sent, err := strconv.ParseInt(string(fields[2]), 10, 64)
+	if err != nil {
+		return false
+	}
+	rtt := time.Since(time.Unix(0, sent))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if seq == 0 || seq > p.seq {
+		return false
+	}
+	note := ""
+	switch {
+	case !p.pending[seq]:
+		p.repeated++
+		note = " (duplicate)"
+	case seq < p.last:
+		p.late++
+		note = " (out of order)"
+	}
+	if p.pending[seq] {
+		delete(p.pending, seq)
+		p.samples = append(p.samples, rtt)
+		if seq > p.last {
+			p.last = seq
+		}
+	}
+
+	if !raw {
+		fmt.Fprintf(stdout, "\r%srtt seq=%d %v%s\n", linePrefix(), seq, rtt.Round(time.Microsecond), note)
+		printPrompt()
+	}
+	return true
+}
+
+// printLatency prints a summary of the round trip times measured.
+func printLatency() {
+	latency.mu.Lock()
+	defer latency.mu.Unlock()
+
+	samples := append([]time.Duration(nil), latency.samples...)
+	lost := len(latency.pending)
+	if len(samples) == 0 {
+		fmt.Fprintf(os.Stderr, "\r%d probes sent, none answered\n", latency.seq)
+		return
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+
+	var total time.Duration
+	for _, rtt := range samples {
+		total += rtt
+	}
+	round := func(d time.Duration) time.Duration { return d.Round(time.Microsecond) }
+	fmt.Fprintf(os.Stderr, "\r%d probes sent, %d answered, %d lost, %d out of order, %d duplicates\n",
+		latency.seq, len(samples), lost, latency.late, latency.repeated)
+	fmt.Fprintf(os.Stderr, "rtt min/avg/max/p50/p99 = %v/%v/%v/%v/%v\n",
+		round(samples[0]), round(total/time.Duration(len(samples))), round(samples[len(samples)-1]),
+		round(percentile(samples, 50)), round(percentile(samples, 99)))
+}
+
+// percentile returns the nth percentile of sorted, by the nearest rank.
+func percentile(sorted []time.Duration, n int) time.Duration {
+	rank := (n*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
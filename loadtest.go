@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/medvedev/wsd/wsd"
+)
+
+// loadResults sums up what the -connections went through.
+type loadResults struct {
+	mu         sync.Mutex
+	setupTimes []time.Duration
+	failed     int
+
+	sentMessages     atomic.Int64
+	sentBytes        atomic.Int64
+	receivedMessages atomic.Int64
+	receivedBytes    atomic.Int64
+	errors           atomic.Int64
+}
+
+// loadTest opens the -connections, each sending the -message -rate times a
+// second, until ctx is done. It prints a summary and returns the exit status.
+func loadTest(ctx context.Context) int {
+	var results loadResults
+	var workers sync.WaitGroup
+
+	start := time.Now()
+	for i := 0; i < connections; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			loadConnection(ctx, &results)
+		}()
+	}
+	workers.Wait()
+
+	results.print(time.Since(start))
+	if results.failed == connections {
+		return 1
+	}
+	return 0
+}
+
+// loadConnection connects and sends messages until ctx is done.
+func loadConnection(ctx context.Context, results *loadResults) {
+	begin := time.Now()
+	client, err := connect(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			fmt.Fprintf(os.Stderr, "\rconnection failed: %s\n", red(describeDialError(err)))
+		}
+		results.mu.Lock()
+		results.failed++
+		results.mu.Unlock()
+		return
+	}
+	results.mu.Lock()
+	results.setupTimes = append(results.setupTimes, time.Since(begin))
+	results.mu.Unlock()
+
+	received := make(chan struct{})
+	go func() {
+		defer close(received)
+		for msg := range client.Messages() {
+			results.receivedMessages.Add(1)
+			results.receivedBytes.Add(int64(len(msg.Data)))
+		}
+	}()
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+
+	msg := wsd.Message{Type: sendType(), Data: []byte(message)}
+	for {
+		select {
+		case <-ticker.C:
+			if err := client.Send(msg); err != nil {
+				results.errors.Add(1)
+				client.Close(closeCode, closeReason)
+				<-received
+				return
+			}
+			results.sentMessages.Add(1)
+			results.sentBytes.Add(int64(len(msg.Data)))
+		case <-received:
+			if client.Err() != nil {
+				results.errors.Add(1)
+			}
+			return
+		case <-ctx.Done():
+			client.Close(closeCode, closeReason)
+			<-received
+			return
+		}
+	}
+}
+
+func (r *loadResults) print(elapsed time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	perSecond := func(n int64) float64 { return float64(n) / elapsed.Seconds() }
+
+	fmt.Fprintf(os.Stderr, "\r%-12s %d opened, %d failed\n", "connections", len(r.setupTimes), r.failed)
+	if len(r.setupTimes) > 0 {
+		shortest, longest, total := r.setupTimes[0], r.setupTimes[0], time.Duration(0)
+		for _, d := range r.setupTimes {
+			shortest, longest, total = min(shortest, d), max(longest, d), total+d
+		}
+		fmt.Fprintf(os.Stderr, "%-12s min/avg/max = %v/%v/%v\n", "setup",
+			shortest.Round(time.Microsecond), (total / time.Duration(len(r.setupTimes))).Round(time.Microsecond), longest.Round(time.Microsecond))
+	}
+	fmt.Fprintf(os.Stderr, "%-12s %d msgs / %s, %.1f msgs/s\n", "sent",
+		r.sentMessages.Load(), formatBytes(r.sentBytes.Load()), perSecond(r.sentMessages.Load()))
+	fmt.Fprintf(os.Stderr, "%-12s %d msgs / %s, %.1f msgs/s\n", "received",
+		r.receivedMessages.Load(), formatBytes(r.receivedBytes.Load()), perSecond(r.receivedMessages.Load()))
+	fmt.Fprintf(os.Stderr, "%-12s %d\n", "errors", r.errors.Load())
+	fmt.Fprintf(os.Stderr, "%-12s %s\n", "duration", formatDuration(elapsed))
+}
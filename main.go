@@ -2,117 +2,1421 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/fatih/color"
-	"golang.org/x/net/websocket"
+	"github.com/mattn/go-isatty"
+	"github.com/medvedev/wsd/wsd"
 )
 
+// palette are the colors we print with, enabled by -color always even though
+// NO_COLOR is set.
+var palette []*color.Color
+
+func newColor(attribute color.Attribute) func(a ...interface{}) string {
+	c := color.New(attribute)
+	palette = append(palette, c)
+	return c.SprintFunc()
+}
+
+// colorModes are the values of -color.
+var colorModes = []string{"always", "auto", "never"}
+
 // Version is the current version.
 const Version = "0.1.0"
 
+// maxControlPayload is the size limit of the payload of ping frames, set by
+// RFC 6455.
+const maxControlPayload = 125
+
+// errMaxDuration ends the session once the -maxDuration elapsed.
+var errMaxDuration = errors.New("-maxDuration elapsed")
+
+// Bounds of the delay between two reconnection attempts.
+const (
+	minReconnectDelay = 500 * time.Millisecond
+	maxReconnectDelay = 30 * time.Second
+)
+
 var (
 	origin             string
 	url                string
+	profile            string
+	followRedirects    bool
+	maxRedirects       int
+	urlArg             string
 	protocol           string
 	userAgent          string
+	proxy              string
+	socks5             string
 	displayHelp        bool
 	displayVersion     bool
+	completionShell    string
 	bufSize            int
 	insecureSkipVerify bool
 	raw                bool
-	red                = color.New(color.FgRed).SprintFunc()
-	magenta            = color.New(color.FgMagenta).SprintFunc()
-	green              = color.New(color.FgGreen).SprintFunc()
-	yellow             = color.New(color.FgYellow).SprintFunc()
-	cyan               = color.New(color.FgCyan).SprintFunc()
+	quiet              bool
+	forceInteractive   bool
+	escape             bool
+	noHistory          bool
+	historyFile        string
+	message            string
+	keepOpen           bool
+	timeout            time.Duration
+	maxDuration        time.Duration
+	metricsAddr        string
+	headers            = headerFlag{}
+	resolve            = resolveFlag{}
+	cookies            cookieFlag
+	cookieFile         string
+	token              string
+	tokenFile          string
+	basicAuth          string
+	reconnect          bool
+	exitOnClose        bool
+	count              int
+	repeat             string
+	onConnect          string
+	repeatInterval     time.Duration
+	repeatCount        int
+	templates          bool
+	idleTimeout        time.Duration
+	maxMessageSize     int64
+	latencyInterval    time.Duration
+	latencyEcho        string
+	maxRetries         int
+	pingInterval       time.Duration
+	pingPayload        string
+	autoPong           bool
+	binaryMode         bool
+	hexdump            bool
+	hexInput           bool
+	appendNewline      bool
+	connections        int
+	rate               float64
+	sendBinary         atomic.Bool // toggled by /binary and /text
+	cmdPrefix          string
+	showStats          bool
+	prettyJSON         bool
+	prettyIndent       string
+	compactJSON        bool
+	noColor            bool
+	colorMode          string
+	timestamps         bool
+	timeFormat         string
+	utc                bool
+	printHeaders       bool
+	showCert           bool
+	verbose            bool
+	strict             bool
+	compress           bool
+	certFile           string
+	keyFile            string
+	caCertFile         string
+	caPath             string
+	alpn               string
+	caPathCerts        []*x509.Certificate
+	serverName         string
+	minTLS             string
+	minTLSVersion      uint16
+	pin                string
+	pinnedFingerprint  []byte
+	inputFiles         stringsFlag
+	rawInput           bool
+	exitOnStdinClose   bool
+	outputFile         string
+	sendBinaryFile     string
+	inputs             []*os.File
+	delay              time.Duration
+	grace              time.Duration
+	record             string
+	replay             string
+	speed              float64
+	red                = newColor(color.FgRed)
+	magenta            = newColor(color.FgMagenta)
+	green              = newColor(color.FgGreen)
+	yellow             = newColor(color.FgYellow)
+	cyan               = newColor(color.FgCyan)
+	faint              = newColor(color.Faint)
+	bold               = newColor(color.Bold)
 	wg                 sync.WaitGroup
+	grep               string
+	grepv              string
+	grepPattern        *regexp.Regexp
+	grepvPattern       *regexp.Regexp
+	expect             string
+	expectPattern      *regexp.Regexp
+	expectMet          atomic.Bool
+	outputFormat       string
+	sendDelimiter      string
+	nullDelimited      bool
+	noHeredoc          bool
+	closeCode          int
+	closeReason        string
+	connectionIDs      bool
+	numbers            bool
+	resetNumbers       bool
+	dryRun             bool
+	rawDelimiter       string
+	rawSeparator       []byte
+	unixSocket         string
+	bind               string
+	noDelay            bool
+	tcpKeepAlive       time.Duration
+	timing             bool
+	localAddr          *net.TCPAddr
+	delimiter          []byte
+	// printedMessages counts the messages received that passed the -grep
+	// filters, across reconnections.
+	printedMessages atomic.Int64
+	// numbered counts the messages numbered by -number.
+	numbered atomic.Int64
 )
 
 func init() {
-	flag.StringVar(&origin, "origin", "http://localhost/", "origin of WebSocket client")
-	flag.StringVar(&url, "url", "ws://localhost:1337/ws", "WebSocket server address to connect to")
-	flag.StringVar(&protocol, "protocol", "", "WebSocket subprotocol")
-	flag.StringVar(&userAgent, "userAgent", "", "User-Agent header")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		printDefaults()
+	}
+
+	flag.StringVar(&origin, "origin", "http://localhost/", "origin of WebSocket client, an empty origin omits the Origin header, defaults to WSD_ORIGIN")
+	flag.StringVar(&url, "url", "ws://localhost:1337/ws", "WebSocket server address to connect to, can also be given as the argument, defaults to WSD_URL")
+	flag.StringVar(&profile, "profile", "", "Profile of ~/.config/wsd/config.yaml giving the values of the flags not on the command line")
+	flag.BoolVar(&followRedirects, "followRedirects", false, "Follow the redirections of the handshake to other ws:// or wss:// URLs, never from wss:// to ws://")
+	flag.IntVar(&maxRedirects, "maxRedirects", 10, "Number of redirections to follow with -followRedirects")
+	flag.StringVar(&protocol, "protocol", "", "WebSocket subprotocols to offer, comma separated in order of preference")
+	flag.StringVar(&userAgent, "userAgent", "wsd/"+Version, "User-Agent header, -userAgent \"\" sends none")
+	flag.StringVar(&proxy, "proxy", "", "HTTP proxy to connect through as http://[user:password@]host:port, defaults to HTTP_PROXY or HTTPS_PROXY")
+	flag.StringVar(&bind, "bind", "", "Local address to connect from, as ip or ip:port")
+	flag.Var(resolve, "resolve", "Connect to addr instead of host given as host:addr, where addr is ip or ip:port, can be repeated")
+	flag.DurationVar(&tcpKeepAlive, "tcpKeepAlive", 15*time.Second, "Interval between the TCP keepalive probes detecting dead peers without WebSocket traffic (0 disables them)")
+	flag.BoolVar(&timing, "timing", false, "Print to stderr how long the DNS resolution, the TCP connection, the TLS handshake and the WebSocket upgrade took")
+	flag.BoolVar(&noDelay, "noDelay", true, "Set TCP_NODELAY for the small frames to be sent right away, -noDelay=false enables Nagle's algorithm instead (TCP only, not -unixSocket)")
+	flag.StringVar(&unixSocket, "unixSocket", "", "Unix socket to connect to instead of the host of the -url, which is still sent as the Host header")
+	flag.StringVar(&socks5, "socks5", "", "SOCKS5 proxy to connect through as [user:password@]host:port, defaults to ALL_PROXY")
+	flag.StringVar(&tokenFile, "tokenFile", "", "File to read the bearer token from, again on every reconnection for rotated tokens to be picked up")
+	flag.StringVar(&token, "token", "", "Bearer token to authenticate with, read from the environment if it starts with $, defaults to WSD_TOKEN")
+	flag.StringVar(&basicAuth, "basicAuth", "", "Credentials for HTTP basic authentication as user:password")
+	flag.Var(headers, "header", "Header to send with the handshake as \"Key: Value\", can be repeated, defaults to the ones of WSD_HEADER separated by semicolons")
+	flag.Var(&cookies, "cookie", "Cookie to send with the handshake as name=value, can be repeated, the cookies set by the server being sent on reconnection and redirection too")
+	flag.StringVar(&cookieFile, "cookieFile", "", "File of the cookies to send, one name=value per line, which the cookies of the server are saved to on exit")
+	flag.StringVar(&certFile, "cert", "", "PEM file of the client certificate to authenticate with, requires -key")
+	flag.StringVar(&keyFile, "key", "", "PEM file of the private key of the -cert")
+	flag.StringVar(&caCertFile, "cacert", "", "PEM file of the CA certificates to trust instead of the system ones")
+	flag.StringVar(&caPath, "capath", "", "Directory of the .pem and .crt files of the CA certificates to trust instead of the system ones, along with the -cacert")
 	flag.BoolVar(&insecureSkipVerify, "insecureSkipVerify", false, "Skip TLS certificate verification")
+	flag.StringVar(&serverName, "serverName", "", "Host name to send in the TLS SNI and verify the certificate against, instead of the one of the -url")
+	flag.StringVar(&alpn, "alpn", "", "ALPN protocols to offer in the TLS handshake, comma separated in order of preference")
+	flag.StringVar(&minTLS, "minTLS", "1.2", "Minimum TLS version to accept: 1.0, 1.1, 1.2 or 1.3")
+	flag.StringVar(&pin, "pin", "", "SHA-256 fingerprint in hex of the only server certificate to accept, trusted even if self-signed")
 	flag.BoolVar(&displayHelp, "help", false, "Display help information about wsd")
 	flag.BoolVar(&displayVersion, "version", false, "Display version number")
+	flag.StringVar(&completionShell, "completion", "", "Print the completion script of the given shell: bash, zsh or fish")
+	flag.BoolVar(&escape, "escape", true, "Show the control characters of the messages received as \\x1b escapes, but for newlines and tabs, lest they garble the terminal")
 	flag.BoolVar(&raw, "raw", false, "Don't format the messages received and don't launch an interactive shell")
-	flag.IntVar(&bufSize, "bufSize", 1024, "Inbound messages buffer size")
+	flag.StringVar(&rawDelimiter, "rawDelimiter", "\\n", "Delimiter written after each message received with -raw, understanding the escapes of -sendDelimiter, empty for none")
+	flag.BoolVar(&forceInteractive, "interactive", false, "Print the banners and the prompt even though stdin isn't a terminal, which otherwise implies -quiet")
+	flag.BoolVar(&quiet, "quiet", false, "Don't print the banners and the prompt, unlike -raw the messages are still formatted and read from stdin")
+	flag.BoolVar(&noHistory, "noHistory", false, "Don't save the lines typed to the -historyFile, for sessions typing secrets")
+	flag.StringVar(&historyFile, "historyFile", "", "File to save the lines typed to (default $XDG_DATA_HOME/wsd/history, ~/.local/share/wsd/history without XDG_DATA_HOME)")
+	flag.StringVar(&message, "message", "", "Send this message, print the first response and exit")
+	flag.BoolVar(&keepOpen, "keepOpen", false, "Keep printing the responses to the -message until the -timeout or an interrupt, unless -count or -expect end it first")
+	flag.BoolVar(&rawInput, "rawInput", false, "Send the whole stdin as a single binary message once read, then exit")
+	flag.BoolVar(&exitOnStdinClose, "exitOnStdinClose", false, "Close the connection and exit once stdin is closed and the -grace period is over")
+	flag.Var(&inputFiles, "inputFile", "Send each line of this file as a message instead of reading stdin, then exit, can be repeated or be a glob to send several files in order")
+	flag.DurationVar(&delay, "delay", 0, "Time to wait between two messages sent from the -inputFile or a piped stdin")
+	flag.DurationVar(&grace, "grace", time.Second, "Time to wait for late responses once the -inputFile, stdin with -exitOnStdinClose, the -repeatCount or the -replay messages are sent")
+	flag.StringVar(&sendBinaryFile, "sendBinaryFile", "", "Send the content of this file as a single binary message once connected")
+	flag.StringVar(&outputFormat, "output", "text", "Format of the output: text, or ndjson for a JSON object per message sent or received and per connection event")
+	flag.StringVar(&record, "record", "", "Write the messages sent and received to this file, as -output ndjson records to -replay")
+	flag.StringVar(&replay, "replay", "", "Send the messages sent of this -record transcript at their recorded pace, then exit")
+	flag.Float64Var(&speed, "speed", 1, "Multiplier of the pace of the -replay, 2 sending the messages twice as fast (0 sends them without waiting)")
+	flag.StringVar(&outputFile, "outputFile", "", "Also append the messages received to this file, - writes them to stdout instead of formatting them")
+	flag.IntVar(&connections, "connections", 0, "Load test the server with this many connections sending the -message until interrupted")
+	flag.Float64Var(&rate, "rate", 1, "Number of -message sent per second by each of the -connections")
+	flag.StringVar(&metricsAddr, "metricsAddr", "", "Serve the traffic stats on /metrics of this address, such as :9100, for Prometheus to scrape")
+	flag.DurationVar(&maxDuration, "maxDuration", 0, "Close the connection and exit after this long, whatever the activity (0 means no limit)")
+	flag.DurationVar(&timeout, "timeout", 30*time.Second, "Timeout for connecting and for the responses to -message, the -count messages or the one to -expect (0 means no timeout)")
+	flag.BoolVar(&reconnect, "reconnect", false, "Reconnect automatically when the connection drops")
+	flag.IntVar(&closeCode, "closeCode", wsd.CloseNormalClosure, "Status code of the close frame sent when we close the connection")
+	flag.StringVar(&closeReason, "closeReason", "", "Reason of the close frame sent when we close the connection, up to 123 bytes")
+	flag.BoolVar(&exitOnClose, "exitOnClose", false, "Exit with status 3 when the server closes the connection with another status than 1000")
+	flag.IntVar(&count, "count", 0, "Exit after receiving this many messages, failing if they don't all arrive within the -timeout (0 means no limit)")
+	flag.StringVar(&onConnect, "onConnect", "", "Send each line of this file as a message every time the connection is established, reconnections included, before the input")
+	flag.StringVar(&repeat, "repeat", "", "Send this message every -interval along with the input")
+	flag.DurationVar(&repeatInterval, "interval", time.Second, "Time to wait between two -repeat messages")
+	flag.IntVar(&repeatCount, "repeatCount", 0, "Close the connection once the -repeat message is sent this many times and the -grace period is over (0 means no limit)")
+	flag.BoolVar(&templates, "template", false, "Expand the placeholders of the messages sent: {{.Seq}}, {{.Timestamp}} and {{.UUID}}")
+	flag.Int64Var(&maxMessageSize, "maxMessageSize", 32<<20, "Size in bytes of the largest message to accept, larger ones close the connection with status 1009 (0 means no limit)")
+	flag.DurationVar(&idleTimeout, "idleTimeout", 0, "Close the connection and exit when no message is received for this long (0 means no timeout)")
+	flag.IntVar(&maxRetries, "maxRetries", 0, "Number of reconnection attempts before giving up (0 means forever)")
+	flag.DurationVar(&pingInterval, "ping", 0, "Interval between ping frames sent to keep the connection alive (0 disables pings)")
+	flag.StringVar(&pingPayload, "pingPayload", "", "Payload of the pings sent every -ping")
+	flag.BoolVar(&autoPong, "autoPong", true, "Answer the pings of the server with a pong, -autoPong=false to test how it handles unresponsive clients")
+	flag.DurationVar(&latencyInterval, "latency", 0, "Interval between the pings sent to measure the round trip time, summed up on exit (0 disables it)")
+	flag.StringVar(&latencyEcho, "latencyEcho", "", "Measure the -latency with text messages starting with this tag that the server echoes, instead of pings")
+	flag.BoolVar(&binaryMode, "binary", false, "Send binary frames instead of text frames and hex dump the binary frames received")
+	flag.BoolVar(&hexdump, "hexdump", false, "Hex dump the binary frames received, and the text frames that aren't printable")
+	flag.BoolVar(&hexInput, "hexInput", false, "Send binary frames of the bytes spelled in hex by each line, like \"0a ff 00\" or \"0aff00\"")
+	flag.BoolVar(&nullDelimited, "null", false, "Delimit the messages with NUL bytes rather than newlines, as find -print0 does, same as -sendDelimiter '\\0'")
+	flag.BoolVar(&nullDelimited, "z", false, "Shorthand for -null")
+	flag.StringVar(&sendDelimiter, "sendDelimiter", "", "Delimiter of the messages in the -inputFile or a piped stdin instead of newlines, understanding \\n, \\r, \\t, \\0 and \\\\")
+	flag.BoolVar(&noHeredoc, "noHeredoc", false, "Send the lines starting with << as is: otherwise a line like <<END starts a multi-line message, ended by a line equal to END")
+	flag.BoolVar(&appendNewline, "appendNewline", false, "End the messages sent with a newline, which stdin lines are stripped of")
+	flag.BoolVar(&prettyJSON, "json", false, "Indent and color the JSON messages received")
+	flag.StringVar(&prettyIndent, "prettyIndent", "2", "Indentation of the -json messages, as a number of spaces or the indentation itself like \\t")
+	flag.BoolVar(&compactJSON, "compactJSON", false, "Print the JSON messages received on a single line, colored")
+	flag.StringVar(&grep, "grep", "", "Only print the messages received that match this regular expression, highlighting the matches")
+	flag.StringVar(&expect, "expect", "", "Exit once a message matching this regular expression is received, failing if none arrives within the -timeout")
+	flag.StringVar(&grepv, "grepv", "", "Only print the messages received that don't match this regular expression")
+	flag.BoolVar(&noColor, "noColor", false, "Disable colors, same as -color never")
+	flag.StringVar(&colorMode, "color", "auto", "When to use colors: always, auto when stdout is a terminal and NO_COLOR isn't set, or never")
+	flag.BoolVar(&timestamps, "timestamps", false, "Prefix the messages sent and received with the time")
+	flag.StringVar(&timeFormat, "timeFormat", "15:04:05.000", "Go layout of the -timestamps")
+	flag.BoolVar(&connectionIDs, "connectionIDs", false, "Prefix the messages printed with the number of their connection, counting the reconnections")
+	flag.BoolVar(&numbers, "number", false, "Number the messages received, like cat -n")
+	flag.BoolVar(&resetNumbers, "resetNumbersOnReconnect", false, "Number the messages received from 1 again on every reconnection, for -number and -reconnect")
+	flag.BoolVar(&utc, "utc", false, "Use UTC for the -timestamps instead of the local time")
+	flag.BoolVar(&printHeaders, "printHeaders", false, "Print the status and headers of the handshake response")
+	flag.BoolVar(&showCert, "showCert", false, "Print the subject, issuer, validity, names and SHA-256 fingerprint of the certificates of wss servers")
+	flag.BoolVar(&dryRun, "dryRun", false, "Print the handshake request that would be sent, without connecting")
+	flag.BoolVar(&verbose, "verbose", false, "Log the handshake to stderr, along with the TLS details")
+	flag.BoolVar(&strict, "strict", false, "Close the connection with status 1007 when a text message isn't valid UTF-8, instead of replacing the invalid bytes")
+	flag.BoolVar(&compress, "compress", false, "Offer the permessage-deflate extension to compress the messages, if the server accepts it")
+	flag.StringVar(&cmdPrefix, "cmdPrefix", "/", "Prefix of the interactive commands, an empty prefix disables them")
+	flag.BoolVar(&showStats, "stats", false, "Print how many messages and bytes were exchanged on exit")
+	flag.IntVar(&bufSize, "bufSize", 1024, "Deprecated: inbound messages are reassembled regardless of their size")
 }
 
-func inLoop(ws *websocket.Conn) {
-	msg := make([]byte, bufSize)
+// headerFlag collects the headers given through repeated -header flags.
+type headerFlag http.Header
 
-	for {
-		n, err := ws.Read(msg)
+func (h headerFlag) String() string {
+	var pairs []string
+	for key, values := range h {
+		for _, value := range values {
+			pairs = append(pairs, key+": "+value)
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
 
-		if err != nil {
-			printError(err)
-			continue
+func (h headerFlag) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expected \"Key: Value\", got %q", value)
+	}
+
+	key := strings.TrimSpace(parts[0])
+	if key == "" {
+		return fmt.Errorf("missing header name in %q", value)
+	}
+
+	http.Header(h).Add(key, strings.TrimSpace(parts[1]))
+	return nil
+}
+
+// stringsFlag collects the values of a repeated flag, in order.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// resolveFlag collects the addresses given through repeated -resolve flags.
+type resolveFlag map[string]string
+
+func (r resolveFlag) String() string {
+	var pairs []string
+	for host, addr := range r {
+		pairs = append(pairs, host+":"+addr)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+func (r resolveFlag) Set(value string) error {
+	host, addr, ok := strings.Cut(value, ":")
+	if !ok || host == "" || addr == "" {
+		return fmt.Errorf("expected \"host:addr\", got %q", value)
+	}
+
+	r[strings.ToLower(host)] = addr
+	return nil
+}
+
+func inLoop(ctx context.Context, client *wsd.Client, done chan<- struct{}, closing chan<- closeRequest) {
+	defer wg.Done()
+	defer close(done)
+
+	for {
+		select {
+		case msg, ok := <-client.Messages():
+			if !ok {
+				if err := client.Err(); err != nil {
+					printError(err)
+				}
+				return
+			}
+			stats.countReceived(msg)
+			transcribe("recv", msg)
+			if err := checkUTF8(msg); err != nil {
+				printError(err)
+				select {
+				case closing <- closeRequest{code: wsd.CloseInvalidFramePayloadData, reason: "invalid UTF-8"}:
+				case <-ctx.Done():
+				}
+				return
+			}
+			if latencyEcho != "" && msg.Type == wsd.TextMessage && latency.answer(msg.Data) {
+				continue
+			}
+			if !printReceivedMessage(msg) {
+				continue
+			}
+			printedMessages.Add(1)
+			checkExpected(msg)
+			if gotAwaited() {
+				return
+			}
+		case <-ctx.Done():
+			return
 		}
+	}
+}
 
-		printReceivedMessage(msg[:n])
+// checkExpected records whether msg is the message to -expect.
+func checkExpected(msg wsd.Message) {
+	if expectPattern != nil && expectPattern.Match(msg.Data) {
+		expectMet.Store(true)
 	}
+}
 
-	wg.Done()
+// awaiting reports whether we wait for the -count messages or the message
+// to -expect before exiting.
+func awaiting() bool {
+	return count > 0 || expectPattern != nil
 }
 
-func printError(err error) {
-	if err == io.EOF {
-		fmt.Fprintf(os.Stderr, "\r✝ %v - connection closed by remote\n", magenta(err))
-		os.Exit(0)
+// gotAwaited reports whether we received the -count messages we wanted, only
+// counting the messages that match the -grep filters, or the one to -expect.
+func gotAwaited() bool {
+	return count > 0 && printedMessages.Load() >= int64(count) || expectMet.Load()
+}
+
+// missedAwaited reports whether the -timeout expired before we received the
+// -count messages or the one to -expect, saying so if it did.
+func missedAwaited(ctx context.Context) bool {
+	if !awaiting() || !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return false
+	}
+	if expectPattern != nil {
+		fmt.Fprintf(stderr, "\r%s\n", red(fmt.Sprintf("no message matching -expect received within %v", timeout)))
 	} else {
-		fmt.Fprintf(os.Stderr, "\rerr %v\n", red(err))
-		if !raw {
-			fmt.Printf("> ")
+		fmt.Fprintf(stderr, "\r%s\n", red(fmt.Sprintf("received %d of %d messages within %v", printedMessages.Load(), count, timeout)))
+	}
+	return true
+}
+
+// isTimeout reports whether err is a network timeout.
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func printError(err error) {
+	var closeErr *wsd.CloseError
+	if ndjson() {
+		switch {
+		case err == io.EOF:
+			recordEvent(eventRecord{Event: "close", Code: wsd.CloseAbnormalClosure})
+		case errors.As(err, &closeErr):
+			recordEvent(eventRecord{Event: "close", Code: closeErr.Code, Reason: closeErr.Text})
+		default:
+			recordEvent(eventRecord{Event: "error", Error: err.Error()})
 		}
+		return
 	}
+	switch {
+	case err == io.EOF || errors.As(err, &closeErr):
+		fmt.Fprintf(stderr, "\r✝ %v - connection closed by remote\n", magenta(err))
+	case err == wsd.ErrMessageTooBig:
+		fmt.Fprintf(stderr, "\r✝ %v - received a message larger than %d bytes, connection closed with status %d\n", magenta(err), maxMessageSize, wsd.CloseMessageTooBig)
+	default:
+		fmt.Fprintf(stderr, "\rerr %v\n", red(err))
+		printPrompt()
+	}
+}
+
+// interactive reports whether the messages to send are typed by the user.
+func interactive() bool {
+	return !raw && message == "" && len(inputFiles) == 0 && !rawInput
+}
+
+// streaming reports whether the messages to send are read from stdin or
+// from the -inputFile, line by line unless -rawInput.
+func streaming() bool {
+	return interactive() || len(inputFiles) > 0 || rawInput
 }
 
-func printReceivedMessage(msg []byte) {
+// banners reports whether to tell the user how the connection is going.
+func banners() bool {
+	return !raw && !quiet
+}
+
+// updatePrompt has the editor show the prompt again, should it have changed.
+func updatePrompt() {
+	if editor != nil {
+		editor.SetPrompt(prompt())
+		editor.Refresh()
+	}
+}
+
+// printPrompt prints the prompt again after some output. The editor redraws
+// it by itself, along with the line being typed.
+func printPrompt() {
+	if interactive() && !quiet && editor == nil {
+		fmt.Fprint(stdout, prompt())
+	}
+}
+
+// printReceivedMessage prints msg unless the -grep filters leave it out,
+// reporting whether it did.
+func printReceivedMessage(msg wsd.Message) bool {
+	if !matches(msg) {
+		return false
+	}
+
+	if output != nil {
+		output.write(msg)
+		if output.toStdout() {
+			return true
+		}
+	}
+
+	if ndjson() {
+		recordMessage("recv", msg)
+		return true
+	}
+
 	if raw {
-		os.Stdout.Write(msg)
+		// In a single write, so that readers never see a message without
+		// its delimiter: os.Stdout isn't buffered.
+		os.Stdout.Write(append(msg.Data[:len(msg.Data):len(msg.Data)], rawSeparator...))
+		return true
+	}
+
+	prefix := linePrefix()
+	if numbers {
+		prefix += fmt.Sprintf("%3d ", numbered.Add(1))
+	}
+	switch {
+	case msg.Type == wsd.BinaryMessage && dumped(msg):
+		fmt.Fprintf(stdout, "\r%s<b %d bytes\n%s", prefix, len(msg.Data), cyan(hex.Dump(msg.Data)))
+	case dumped(msg):
+		fmt.Fprintf(stdout, "\r%s< %d bytes\n%s", prefix, len(msg.Data), cyan(hex.Dump(msg.Data)))
+	case msg.Type == wsd.BinaryMessage:
+		fmt.Fprintf(stdout, "\r%s<b %s\n", prefix, cyan(escapeControls(string(msg.Data))))
+	default:
+		fmt.Fprintf(stdout, "\r%s< %s\n", prefix, formatText(msg.Data))
+	}
+	printPrompt()
+	return true
+}
+
+// dumped reports whether msg is shown as a hex dump: binary messages are with
+// -binary or -hexdump, text messages that would garble the terminal are with
+// -hexdump.
+func dumped(msg wsd.Message) bool {
+	if msg.Type == wsd.BinaryMessage {
+		return binaryMode || hexdump
+	}
+	return hexdump && !printable(msg.Data)
+}
+
+// printable reports whether text is valid UTF-8 free of control characters
+// other than tabs and line breaks.
+func printable(text []byte) bool {
+	if !utf8.Valid(text) {
+		return false
+	}
+	for _, r := range string(text) {
+		if unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r' {
+			return false
+		}
+	}
+	return true
+}
+
+// printSentMessage echoes msg once it is sent, so that its timestamp shows
+// when it left. Without timestamps, the line typed is echo enough.
+func printSentMessage(msg wsd.Message) {
+	if ndjson() {
+		recordMessage("sent", msg)
+		return
+	}
+	if raw || !timestamps {
+		return
+	}
+
+	if msg.Type == wsd.BinaryMessage {
+		fmt.Fprintf(stdout, "\r%s>b %d bytes\n", linePrefix(), len(msg.Data))
+	} else {
+		fmt.Fprintf(stdout, "\r%s> %s\n", linePrefix(), msg.Data)
+	}
+	printPrompt()
+}
+
+// linePrefix starts the lines printed for the messages: with their time for
+// -timestamps, and the number of their connection for -connectionIDs.
+func linePrefix() string {
+	if !connectionIDs {
+		return timestamp()
+	}
+	return timestamp() + faint(fmt.Sprintf("[#%d]", dialCount.Load())) + " "
+}
+
+func timestamp() string {
+	if !timestamps {
+		return ""
+	}
+
+	now := time.Now()
+	if utc {
+		now = now.UTC()
+	}
+	return faint("["+now.Format(timeFormat)+"]") + " "
+}
+
+func printSubprotocol(selected string) {
+	if selected == "" {
+		fmt.Fprintln(stdout, "negotiated subprotocol: none")
 	} else {
-		fmt.Printf("\r< %s\n> ", cyan(string(msg)))
+		fmt.Fprintf(stdout, "negotiated subprotocol: %s\n", yellow(selected))
+	}
+}
+
+// printResponse prints the status line and the headers of the handshake
+// response.
+func printResponse(resp *http.Response) {
+	fmt.Fprintf(stdout, "%s %s\n", resp.Proto, resp.Status)
+	printHeader(resp.Header)
+}
+
+func printRequest(req *http.Request) {
+	fmt.Fprintf(stdout, "%s %s %s\n", req.Method, req.RequestURI, req.Proto)
+	fmt.Fprintf(stdout, "%s: %s\n", yellow("Host"), req.Host)
+	printHeader(req.Header)
+}
+
+func printHeader(header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, value := range header[name] {
+			fmt.Fprintf(stdout, "%s: %s\n", yellow(name), value)
+		}
+	}
+	fmt.Fprintln(stdout)
+}
+
+// printCertificates prints the certificate chain presented by the server,
+// if the connection is secured by TLS.
+func printCertificates(state *tls.ConnectionState) {
+	if state == nil {
+		return
+	}
+
+	for i, cert := range state.PeerCertificates {
+		var names []string
+		names = append(names, cert.DNSNames...)
+		for _, ip := range cert.IPAddresses {
+			names = append(names, ip.String())
+		}
+		names = append(names, cert.EmailAddresses...)
+		for _, uri := range cert.URIs {
+			names = append(names, uri.String())
+		}
+
+		fmt.Fprintf(stdout, "certificate %d\n", i)
+		fmt.Fprintf(stdout, "%s: %s\n", yellow("subject"), cert.Subject)
+		fmt.Fprintf(stdout, "%s: %s\n", yellow("issuer"), cert.Issuer)
+		fmt.Fprintf(stdout, "%s: %s\n", yellow("not before"), cert.NotBefore.UTC().Format(time.RFC3339))
+		fmt.Fprintf(stdout, "%s: %s\n", yellow("not after"), cert.NotAfter.UTC().Format(time.RFC3339))
+		if len(names) > 0 {
+			fmt.Fprintf(stdout, "%s: %s\n", yellow("names"), strings.Join(names, ", "))
+		}
+		fmt.Fprintf(stdout, "%s: %s\n", yellow("sha256"), formatFingerprint(sha256.Sum256(cert.Raw)))
+		fmt.Fprintln(stdout)
 	}
 }
 
-func outLoop(ws *websocket.Conn, out <-chan []byte) {
-	for msg := range out {
-		_, err := ws.Write(msg)
+// formatFingerprint formats a certificate fingerprint the way openssl does.
+func formatFingerprint(fingerprint [sha256.Size]byte) string {
+	return strings.ReplaceAll(fmt.Sprintf("% X", fingerprint), " ", ":")
+}
+
+func formatText(text []byte) string {
+	if prettyJSON || compactJSON {
+		if formatted, ok := formatJSON(text); ok {
+			return formatted
+		}
+	}
+	valid := escapeControls(string(bytes.ToValidUTF8(text, []byte("\uFFFD"))))
+	if grepPattern != nil {
+		return highlight(valid)
+	}
+	return cyan(valid)
+}
+
+// escapeControls replaces the control characters of text with escapes like
+// \x1b with -escape, leaving newlines and tabs alone.
+func escapeControls(text string) string {
+	if !escape {
+		return text
+	}
+
+	var escaped strings.Builder
+	for _, r := range text {
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			fmt.Fprintf(&escaped, "\\x%02x", r)
+		} else {
+			escaped.WriteRune(r)
+		}
+	}
+	return escaped.String()
+}
+
+// errInvalidUTF8 reports text messages that aren't valid UTF-8 with -strict.
+var errInvalidUTF8 = errors.New("received a text message that isn't valid UTF-8")
+
+// checkUTF8 returns errInvalidUTF8 if msg is an invalid text message and we
+// are -strict about it.
+func checkUTF8(msg wsd.Message) error {
+	if strict && msg.Type == wsd.TextMessage && !utf8.Valid(msg.Data) {
+		return errInvalidUTF8
+	}
+	return nil
+}
+
+// throttled reports whether the -delay applies, which it doesn't to the
+// lines typed by the user.
+func throttled() bool {
+	return delay > 0 && (len(inputFiles) > 0 || !isTerminal(os.Stdin))
+}
+
+func outLoop(ctx context.Context, client *wsd.Client, out <-chan inputLine, closing chan<- closeRequest) {
+	defer wg.Done()
+
+	var lastSent time.Time
+	for {
+		select {
+		case line, ok := <-out:
+			msg := line.data
+			if !ok {
+				if len(inputFiles) > 0 || rawInput || exitOnStdinClose {
+					waitForLateResponses(ctx, closing)
+				}
+				return
+			}
+			if rawInput {
+				sendMessage(client, wsd.Message{Type: wsd.BinaryMessage, Data: msg})
+				continue
+			}
+			if isCommand(msg) {
+				if request := runCommand(client, string(msg)); request != nil {
+					select {
+					case closing <- *request:
+					case <-ctx.Done():
+					}
+					return
+				}
+				continue
+			}
+			sent, err := newMessage(msg)
+			if err != nil {
+				printError(err)
+				continue
+			}
+			if throttled() && !lastSent.IsZero() {
+				select {
+				case <-time.After(time.Until(lastSent.Add(delay))):
+				case <-ctx.Done():
+					return
+				}
+			}
+			if verbose && line.source != "" {
+				fmt.Fprintf(stderr, "\r* %s\n", line.source)
+			}
+			sendMessage(client, sent)
+			lastSent = time.Now()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sendMessage sends msg, accounting for it.
+func sendMessage(client *wsd.Client, msg wsd.Message) {
+	if err := sendTranscribed(client, msg); err != nil {
+		printError(err)
+		return
+	}
+	stats.countSent(msg)
+	printSentMessage(msg)
+}
+
+// waitForLateResponses gives the server the -grace period to answer the
+// last messages we sent, then asks for the connection to be closed.
+func waitForLateResponses(ctx context.Context, closing chan<- closeRequest) {
+	select {
+	case <-time.After(grace):
+	case <-ctx.Done():
+		return
+	}
+
+	select {
+	case closing <- userClose():
+	case <-ctx.Done():
+	}
+}
+
+// inputLine is a message to send read from stdin or the -inputFile.
+type inputLine struct {
+	data []byte
+	// source is the file and line number the message comes from, for the
+	// lines of the -inputFile.
+	source string
+}
+
+// readInput sends the lines read from r to out. It outlives connections so
+// that lines typed while reconnecting are sent once we are back online.
+func readInput(r io.Reader, out chan<- inputLine) {
+	defer close(out)
+	scanInput(r, "", out)
+}
+
+// readInputFiles sends the lines of the -inputFile files to out, one file
+// after the other.
+func readInputFiles(files []*os.File, out chan<- inputLine) {
+	defer close(out)
+	for _, f := range files {
+		scanInput(f, f.Name(), out)
+		f.Close()
+	}
+}
+
+// scanInput sends the lines read from r to out, along with the line of the
+// file of the given name they come from, if any.
+func scanInput(r io.Reader, name string, out chan<- inputLine) {
+	scanner := bufio.NewScanner(r)
+	if delimiter != nil {
+		scanner.Split(splitOn(delimiter))
+	}
+
+	printPrompt()
+	for line := 1; scanner.Scan(); line++ {
+		var source string
+		if name != "" {
+			source = fmt.Sprintf("%s:%d", name, line)
+		}
+		if !interactive() {
+			out <- inputLine{data: []byte(scanner.Text()), source: source}
+		} else if msg, ok := doc.add(scanner.Text()); ok {
+			out <- inputLine{data: msg}
+		}
+		printPrompt()
+	}
+	if err := scanner.Err(); err != nil {
+		printError(err)
+	}
+}
+
+// openInputFiles opens the files of the given names in order, expanding
+// the globs among them.
+func openInputFiles(names []string) ([]*os.File, error) {
+	var files []*os.File
+	for _, name := range names {
+		matches, err := filepath.Glob(name)
 		if err != nil {
-			printError(err)
+			return nil, err
 		}
+		if matches == nil {
+			// Not a glob, or one matching nothing: let os.Open complain.
+			matches = []string{name}
+		}
+		for _, match := range matches {
+			f, err := os.Open(match)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// readAllInput sends all of r to out as a single message.
+func readAllInput(r io.Reader, out chan<- inputLine) {
+	defer close(out)
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		printError(err)
+		return
+	}
+	out <- inputLine{data: data}
+}
+
+// answered reports whether the responses to the -message printed so far are
+// the ones we wait for: the -count first ones, or the one to -expect. With
+// -keepOpen and neither of them, we never are.
+func answered(received int) bool {
+	if keepingOpen() {
+		return false
+	}
+	if expectPattern != nil {
+		return expectMet.Load()
+	}
+	return received >= max(count, 1)
+}
+
+// keepingOpen reports whether the responses to the -message are printed
+// until the -timeout, an interrupt or the server closes the connection.
+func keepingOpen() bool {
+	return keepOpen && count == 0 && expectPattern == nil
+}
+
+// sendOneShot sends the -message and prints the first message received in
+// response to it.
+func sendOneShot(ctx context.Context, client *wsd.Client) error {
+	sent, err := newMessage([]byte(message))
+	if err != nil {
+		return err
+	}
+	if err := sendTranscribed(client, sent); err != nil {
+		return err
+	}
+	stats.countSent(sent)
+	printSentMessage(sent)
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+
+	for received := 0; !answered(received); {
+		select {
+		case reply, ok := <-client.Messages():
+			if !ok {
+				var closeErr *wsd.CloseError
+				err := client.Err()
+				if keepingOpen() && errors.As(err, &closeErr) && closeErr.Code == wsd.CloseNormalClosure {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				return io.EOF
+			}
+			stats.countReceived(reply)
+			transcribe("recv", reply)
+			if err := checkUTF8(reply); err != nil {
+				return err
+			}
+			if printReceivedMessage(reply) {
+				received++
+				checkExpected(reply)
+			}
+		case <-expired:
+			if keepingOpen() {
+				return nil
+			}
+			if expectPattern != nil {
+				return fmt.Errorf("no response matching -expect received within %v", timeout)
+			}
+			if received == 0 {
+				return fmt.Errorf("no response received within %v", timeout)
+			}
+			return fmt.Errorf("received %d of %d responses within %v", received, count, timeout)
+		case <-ctx.Done():
+			// Interrupted, which isn't an error here either.
+			return nil
+		}
+	}
+	return nil
+}
+
+// sendFile sends the content of the -sendBinaryFile as one binary message.
+func sendFile(client *wsd.Client) error {
+	data, err := os.ReadFile(sendBinaryFile)
+	if err != nil {
+		return err
+	}
+
+	sent := wsd.Message{Type: wsd.BinaryMessage, Data: data}
+	if err := sendTranscribed(client, sent); err != nil {
+		return err
+	}
+	stats.countSent(sent)
+	if !raw {
+		fmt.Fprintf(stdout, "\r%s>b %d bytes from %s\n", linePrefix(), len(data), sendBinaryFile)
+	}
+	return nil
+}
+
+func discard(client *wsd.Client) {
+	for range client.Messages() {
+	}
+}
+
+// splitOn is a bufio.SplitFunc splitting on delim, the data past the last
+// delimiter being the last token.
+func splitOn(delim []byte) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.Index(data, delim); i >= 0 {
+			return i + len(delim), data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
 	}
+}
 
-	wg.Done()
+// unescape replaces the escape sequences \n, \r, \t, \0 and \\ of s with the
+// characters they stand for, leaving other backslashes alone.
+func unescape(s string) []byte {
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			out = append(out, s[i])
+			continue
+		}
+		switch s[i+1] {
+		case 'n':
+			out = append(out, '\n')
+		case 'r':
+			out = append(out, '\r')
+		case 't':
+			out = append(out, '\t')
+		case '0':
+			out = append(out, 0)
+		case '\\':
+			out = append(out, '\\')
+		default:
+			out = append(out, s[i])
+			continue
+		}
+		i++
+	}
+	return out
 }
 
-func dial(url, protocol, origin string) (ws *websocket.Conn, err error) {
-	config, err := websocket.NewConfig(url, origin)
+// newMessage returns the message to send for line, which -hexInput makes a
+// binary message of the bytes it spells, spaces aside.
+func newMessage(line []byte) (wsd.Message, error) {
+	if templates {
+		var err error
+		if line, err = expandTemplate(line); err != nil {
+			return wsd.Message{}, err
+		}
+	}
+	if !hexInput {
+		if appendNewline {
+			line = append(line[:len(line):len(line)], '\n')
+		}
+		return wsd.Message{Type: sendType(), Data: line}, nil
+	}
+
+	data, err := hex.DecodeString(strings.Join(strings.Fields(string(line)), ""))
 	if err != nil {
-		return nil, err
+		return wsd.Message{}, fmt.Errorf("invalid hex input: %v", err)
+	}
+	return wsd.Message{Type: wsd.BinaryMessage, Data: data}, nil
+}
+
+// sendType is the type of the messages we send.
+func sendType() wsd.MessageType {
+	if sendBinary.Load() {
+		return wsd.BinaryMessage
+	}
+	return wsd.TextMessage
+}
+
+// checkFlags validates flag combinations and resolves values that depend on
+// the environment.
+func checkFlags() error {
+	// The profile takes precedence over the environment.
+	if profile != "" {
+		if err := applyProfile(); err != nil {
+			return fmt.Errorf("-profile: %w", err)
+		}
+	}
+	if err := applyEnvironment(); err != nil {
+		return err
+	}
+	if flag.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %q, expected a single URL", flag.Args())
+	}
+	if urlArg != "" {
+		// A mistyped scheme is reported along with the right one on connect.
+		if !strings.Contains(urlArg, "://") {
+			return fmt.Errorf("unexpected argument %q, expected a ws:// or wss:// URL", urlArg)
+		}
+		if isFlagSet("url") && url != urlArg {
+			return fmt.Errorf("the URL argument %s differs from the -url %s", urlArg, url)
+		}
+		url = urlArg
+	}
+
+	if strings.HasPrefix(token, "$") {
+		name := token[1:]
+		token = os.Getenv(name)
+		if token == "" {
+			return fmt.Errorf("-token: environment variable %s is not set", name)
+		}
+	}
+	if tokenFile != "" {
+		if token != "" {
+			return errors.New("-tokenFile can't be used along with -token")
+		}
+		if _, err := readTokenFile(tokenFile); err != nil {
+			return fmt.Errorf("-tokenFile: %w", err)
+		}
+	}
+	if (token != "" || tokenFile != "") && http.Header(headers).Get("Authorization") != "" {
+		return errors.New("-token can't be used along with an Authorization header")
+	}
+
+	if proxy != "" && socks5 != "" {
+		return errors.New("-proxy can't be used along with -socks5")
+	}
+	if unixSocket != "" && (proxy != "" || socks5 != "") {
+		return errors.New("-unixSocket can't be used along with -proxy or -socks5")
+	}
+
+	if bind != "" {
+		addr, err := parseBind(bind)
+		if err != nil {
+			return fmt.Errorf("-bind: %w", err)
+		}
+		localAddr = addr
+	}
+
+	if connections > 0 {
+		if message == "" {
+			return errors.New("-connections requires a -message to send")
+		}
+		if rate <= 0 {
+			return errors.New("-rate must be positive")
+		}
+		if time.Duration(float64(time.Second)/rate) <= 0 {
+			return errors.New("-rate can't exceed 1e9 messages per second")
+		}
+	}
+
+	if metricsAddr != "" && connections > 0 {
+		return errors.New("-metricsAddr can't be used along with -connections")
+	}
+
+	if repeat != "" {
+		if message != "" || connections > 0 {
+			return errors.New("-repeat can't be used along with -message or -connections")
+		}
+		if repeatInterval <= 0 {
+			return errors.New("-interval must be positive")
+		}
+	}
+	if templates {
+		// Rather than on every send, for the messages known up front.
+		for _, text := range []string{message, repeat} {
+			if _, err := parseTemplate(text); err != nil {
+				return fmt.Errorf("-template: %w", err)
+			}
+		}
+	}
+
+	if maxRedirects <= 0 {
+		return errors.New("-maxRedirects must be positive")
+	}
+
+	if pingPayload != "" && pingInterval == 0 {
+		return errors.New("-pingPayload requires -ping")
+	}
+	if len(pingPayload) > maxControlPayload {
+		return fmt.Errorf("-pingPayload can't be longer than %d bytes", maxControlPayload)
+	}
+
+	if maxDuration < 0 {
+		return errors.New("-maxDuration can't be negative")
+	}
+	if tcpKeepAlive < 0 {
+		return errors.New("-tcpKeepAlive can't be negative")
+	}
+
+	if maxMessageSize < 0 {
+		return errors.New("-maxMessageSize can't be negative")
+	}
+
+	if rawInput && (message != "" || len(inputFiles) > 0 || replay != "") {
+		return errors.New("-rawInput can't be used along with -message, -inputFile or -replay")
+	}
+
+	if compactJSON && isFlagSet("prettyIndent") {
+		return errors.New("-compactJSON can't be used along with -prettyIndent")
+	}
+	jsonIndent = parseIndent(prettyIndent)
+
+	if keepOpen && message == "" {
+		return errors.New("-keepOpen requires -message")
+	}
+
+	if repeatCount < 0 {
+		return errors.New("-repeatCount can't be negative")
+	}
+	if repeatCount > 0 && repeat == "" {
+		return errors.New("-repeatCount requires -repeat")
+	}
+
+	if grep != "" {
+		pattern, err := regexp.Compile(grep)
+		if err != nil {
+			return fmt.Errorf("-grep: %w", err)
+		}
+		grepPattern = pattern
+	}
+	if expect != "" {
+		pattern, err := regexp.Compile(expect)
+		if err != nil {
+			return fmt.Errorf("-expect: %w", err)
+		}
+		expectPattern = pattern
+	}
+	if grepv != "" {
+		pattern, err := regexp.Compile(grepv)
+		if err != nil {
+			return fmt.Errorf("-grepv: %w", err)
+		}
+		grepvPattern = pattern
+	}
+
+	if !validCloseCode(closeCode) {
+		return fmt.Errorf("-closeCode: %d isn't a status code we may send, expected 1000-1003, 1007-1014 or 3000-4999", closeCode)
+	}
+	if len(closeReason) > 123 {
+		return errors.New("-closeReason: longer than the 123 bytes a close frame can hold")
+	}
+	if !utf8.ValidString(closeReason) {
+		return errors.New("-closeReason: not valid UTF-8")
+	}
+
+	if nullDelimited {
+		if sendDelimiter != "" {
+			return errors.New("-null can't be used along with -sendDelimiter")
+		}
+		delimiter = []byte{0}
+	}
+	if sendDelimiter != "" {
+		delimiter = unescape(sendDelimiter)
+	}
+	rawSeparator = unescape(rawDelimiter)
+
+	switch outputFormat {
+	case "text":
+	case "ndjson":
+		if raw {
+			return errors.New("-output ndjson can't be used along with -raw")
+		}
+		if outputFile == "-" {
+			return errors.New("-output ndjson can't be used along with -outputFile -")
+		}
+		// The records replace the banners and the prompt.
+		quiet = true
+	default:
+		return fmt.Errorf("-output: unknown format %q, expected text or ndjson", outputFormat)
+	}
+
+	// Piped, we behave as a filter.
+	if len(inputFiles) == 0 && message == "" && !isTerminal(os.Stdin) && !forceInteractive {
+		quiet = true
+	}
+	if forceInteractive && isFlagSet("quiet") {
+		return errors.New("-interactive can't be used along with -quiet")
+	}
+
+	if latencyInterval > 0 && message != "" {
+		return errors.New("-latency can't be used along with -message")
+	}
+	if latencyEcho != "" && latencyInterval == 0 {
+		return errors.New("-latencyEcho requires -latency")
+	}
+
+	if noHistory && historyFile != "" {
+		return errors.New("-noHistory can't be used along with -historyFile")
+	}
+
+	if resetNumbers && (!numbers || !reconnect) {
+		return errors.New("-resetNumbersOnReconnect requires -number and -reconnect")
+	}
+
+	if exitOnClose && reconnect {
+		return errors.New("-exitOnClose can't be used along with -reconnect")
+	}
+
+	if len(inputFiles) > 0 {
+		if message != "" {
+			return errors.New("-inputFile can't be used along with -message")
+		}
+		files, err := openInputFiles(inputFiles)
+		if err != nil {
+			return fmt.Errorf("-inputFile: %w", err)
+		}
+		inputs = files
+	}
+
+	if onConnect != "" {
+		if message != "" || connections > 0 {
+			return errors.New("-onConnect can't be used along with -message or -connections")
+		}
+		lines, err := loadOnConnect(onConnect)
+		if err != nil {
+			return fmt.Errorf("-onConnect: %w", err)
+		}
+		onConnectLines = lines
+	}
+
+	if replay != "" {
+		if message != "" || len(inputFiles) > 0 || repeat != "" || connections > 0 {
+			return errors.New("-replay can't be used along with -message, -inputFile, -repeat or -connections")
+		}
+		if speed < 0 {
+			return errors.New("-speed can't be negative")
+		}
+		messages, err := loadReplay(replay)
+		if err != nil {
+			return fmt.Errorf("-replay: %w", err)
+		}
+		replayMessages = messages
+	}
+	if record != "" {
+		t, err := createTranscript(record)
+		if err != nil {
+			return fmt.Errorf("-record: %w", err)
+		}
+		transcript = t
+	}
+
+	if err := seedJar(); err != nil {
+		return err
+	}
+
+	if outputFile != "" {
+		l, err := openOutput(outputFile)
+		if err != nil {
+			return fmt.Errorf("-outputFile: %w", err)
+		}
+		output = l
+	}
+
+	if caPath != "" {
+		certs, err := loadCAPath(caPath)
+		if err != nil {
+			return fmt.Errorf("-capath: %w", err)
+		}
+		caPathCerts = certs
 	}
-	if protocol != "" {
-		config.Protocol = []string{protocol}
+
+	if (certFile == "") != (keyFile == "") {
+		return errors.New("-cert and -key must be given together")
 	}
-	if userAgent != "" {
-		config.Header.Add("User-Agent", userAgent)
+
+	version, err := parseTLSVersion(minTLS)
+	if err != nil {
+		return fmt.Errorf("-minTLS: %w", err)
 	}
-	config.TlsConfig = &tls.Config{
-		InsecureSkipVerify: insecureSkipVerify,
+	minTLSVersion = version
+
+	if pin != "" {
+		fingerprint, err := hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+		if err != nil || len(fingerprint) != sha256.Size {
+			return errors.New("-pin: expected the 64 hex digits of a SHA-256 fingerprint")
+		}
+		pinnedFingerprint = fingerprint
 	}
-	return websocket.DialConfig(config)
+
+	if basicAuth != "" {
+		// The password may contain colons, the username may not.
+		credentials := strings.SplitN(basicAuth, ":", 2)
+		if len(credentials) != 2 {
+			return errors.New("-basicAuth: expected user:password")
+		}
+		if credentials[0] == "" {
+			return errors.New("-basicAuth: username can't be empty")
+		}
+		if token != "" || tokenFile != "" || http.Header(headers).Get("Authorization") != "" {
+			return errors.New("-basicAuth can't be used along with -token, -tokenFile or an Authorization header")
+		}
+	}
+	return nil
+}
+
+// isFlagSet reports whether the flag of the given name was passed.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func isTerminal(f *os.File) bool {
+	return isatty.IsTerminal(f.Fd()) || isatty.IsCygwinTerminal(f.Fd())
 }
 
 func main() {
 	flag.Parse()
+	if flag.NArg() > 0 {
+		// Flags may follow the URL too.
+		urlArg = flag.Arg(0)
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
 
 	if displayVersion {
 		fmt.Fprintf(os.Stdout, "%s version %s\n", os.Args[0], Version)
@@ -121,48 +1425,323 @@ func main() {
 
 	if displayHelp {
 		fmt.Fprintf(os.Stdout, "Usage of %s:\n", os.Args[0])
-		flag.PrintDefaults()
+		printDefaults()
 		os.Exit(0)
 	}
 
-	ws, err := dial(url, protocol, origin)
+	if completionShell != "" {
+		printCompletion, ok := shells[completionShell]
+		if !ok {
+			fmt.Fprintln(os.Stderr, red(fmt.Sprintf("-completion: unknown shell %q, expected bash, zsh or fish", completionShell)))
+			os.Exit(2)
+		}
+		printCompletion(os.Stdout)
+		os.Exit(0)
+	}
 
-	if !raw {
-		if protocol != "" {
-			fmt.Printf("connecting to %s via %s from %s...\n", yellow(url), yellow(protocol), yellow(origin))
-		} else {
-			fmt.Printf("connecting to %s from %s...\n", yellow(url), yellow(origin))
+	if !slices.Contains(colorModes, colorMode) {
+		fmt.Fprintln(os.Stderr, red(fmt.Sprintf("-color: unknown value %q, expected %s", colorMode, strings.Join(colorModes, ", "))))
+		os.Exit(2)
+	}
+	if noColor && colorMode == "always" {
+		fmt.Fprintln(os.Stderr, red("-noColor can't be used along with -color always"))
+		os.Exit(2)
+	}
+	switch {
+	case colorMode == "always":
+		color.NoColor = false
+		for _, c := range palette {
+			c.EnableColor()
 		}
+	case colorMode == "never" || noColor || os.Getenv("NO_COLOR") != "" || !isTerminal(os.Stdout):
+		color.NoColor = true
 	}
 
-	defer ws.Close()
+	sendBinary.Store(binaryMode)
 
+	if err := checkFlags(); err != nil {
+		fmt.Fprintln(os.Stderr, red(err))
+		os.Exit(2)
+	}
+
+	os.Exit(run())
+}
+
+// run connects and exchanges messages until we are done, returning the exit
+// status of the program.
+func run() int {
+	if output != nil {
+		defer output.close()
+	}
+	if transcript != nil {
+		defer transcript.close()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Nudge interactive users, without polluting logs.
+	if insecureSkipVerify && !raw && isTerminal(os.Stderr) {
+		fmt.Fprintln(os.Stderr, bold("WARNING: TLS certificate verification disabled"))
+	}
+
+	if maxDuration > 0 {
+		// Canceled rather than past a deadline, for the session to end the
+		// way it does on interrupts rather than the -timeout.
+		var end context.CancelCauseFunc
+		ctx, end = context.WithCancelCause(ctx)
+		defer end(nil)
+		defer time.AfterFunc(maxDuration, func() { end(errMaxDuration) }).Stop()
+	}
+
+	if dryRun {
+		return printDryRun()
+	}
+	if connections > 0 {
+		return loadTest(ctx)
+	}
+
+	if metricsAddr != "" {
+		server, err := serveMetrics(metricsAddr)
+		if err != nil {
+			printError(fmt.Errorf("-metricsAddr: %w", err))
+			return 1
+		}
+		defer server.Close()
+	}
+
+	client, err := connect(ctx)
+	if err != nil && context.Cause(ctx) == errMaxDuration {
+		err = errMaxDuration
+	}
 	if err != nil {
-		panic(err)
+		if ndjson() {
+			recordEvent(eventRecord{Event: "error", URL: url, Error: describeDialError(err)})
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "failed to connect to %s: %s\n", url, red(describeDialError(err)))
+		return 1
+	}
+	stats.connected.Store(true)
+	if ndjson() {
+		recordEvent(eventRecord{Event: "open", URL: url, Subprotocol: client.Subprotocol()})
+	}
+	// The URL of the last successful connection, client being nil once
+	// reconnecting failed.
+	lastURL := client.URL()
+	if cookieFile != "" {
+		defer func() { saveCookies(lastURL) }()
 	}
 
-	if !raw {
-		fmt.Printf("successfully connected to %s\n\n", green(url))
+	if banners() {
+		via, from := "", ""
+		if protocol != "" {
+			via = " via " + yellow(protocol)
+		}
+		if origin != "" {
+			from = " from " + yellow(origin)
+		}
+		fmt.Fprintf(stdout, "connecting to %s%s%s...\n", yellow(url), via, from)
 	}
 
-	if !raw {
-		out := make(chan []byte)
-		defer close(out)
+	if banners() {
+		fmt.Fprintf(stdout, "successfully connected to %s\n", green(client.URL()))
+		if protocol != "" {
+			printSubprotocol(client.Subprotocol())
+		}
+		fmt.Fprintln(stdout)
+	}
 
-		wg.Add(1)
-		go outLoop(ws, out)
+	if printHeaders {
+		printResponse(client.Response())
+	}
+	if showCert {
+		printCertificates(client.TLSState())
+	}
+
+	if showStats {
+		defer printStats()
+	}
+	if latencyInterval > 0 {
+		defer printLatency()
+	}
+
+	if sendBinaryFile != "" {
+		if err := sendFile(client); err != nil {
+			printError(err)
+			client.Close(closeCode, closeReason)
+			return 1
+		}
+	}
+
+	if message != "" {
+		err := sendOneShot(ctx, client)
+		// Discard what follows the response, lest the client wait for us
+		// to receive it before it can close.
+		go discard(client)
+		if err == errInvalidUTF8 {
+			client.Close(wsd.CloseInvalidFramePayloadData, "invalid UTF-8")
+		} else {
+			client.Close(closeCode, closeReason)
+		}
+		if err != nil {
+			printError(err)
+			return 1
+		}
+		return 0
+	}
+
+	out := make(chan inputLine)
+	switch {
+	case len(inputFiles) > 0:
+		go readInputFiles(inputs, out)
+	case rawInput:
+		go readAllInput(os.Stdin, out)
+	case interactive() && isTerminal(os.Stdin):
+		if err := openEditor(); err != nil {
+			printError(err)
+			return 1
+		}
+		defer closeEditor()
+		go readTerminal(out, stop)
+	case interactive():
+		go readInput(os.Stdin, out)
+	}
+
+	if awaiting() && timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	for {
+		finished := runSession(ctx, client, out)
+		stats.connected.Store(false)
+		if missedAwaited(ctx) {
+			return 1
+		}
+		if finished {
+			return 0
+		}
+		if exitOnClose {
+			return closeStatus(client.Err())
+		}
+		if client.Err() == wsd.ErrIdleTimeout {
+			return 0
+		}
+		if !reconnect {
+			return 0
+		}
 
-		scanner := bufio.NewScanner(os.Stdin)
+		client, err = redial(ctx)
+		if missedAwaited(ctx) {
+			return 1
+		}
+		if err == errInterrupted {
+			return 0
+		}
+		if err != nil {
+			if ndjson() {
+				recordEvent(eventRecord{Event: "error", URL: url, Error: err.Error()})
+				return 1
+			}
+			fmt.Fprintf(stderr, "failed to reconnect to %s: %s\n", url, red(err))
+			return 1
+		}
+		lastURL = client.URL()
+		stats.connected.Store(true)
+		stats.reconnections.Add(1)
+		if resetNumbers {
+			numbered.Store(0)
+		}
+		if ndjson() {
+			recordEvent(eventRecord{Event: "open", URL: url, Subprotocol: client.Subprotocol()})
+		}
 
-		fmt.Print("> ")
-		for scanner.Scan() {
-			out <- []byte(scanner.Text())
-			fmt.Print("> ")
+		if banners() {
+			fmt.Fprintf(stdout, "\rreconnected to %s\n", green(url))
+		}
+		if printHeaders {
+			printResponse(client.Response())
 		}
+		if showCert {
+			printCertificates(client.TLSState())
+		}
+		printPrompt()
 	}
+}
+
+// closeStatus is the exit status with -exitOnClose of a connection closed
+// by the server with err.
+func closeStatus(err error) int {
+	var closeErr *wsd.CloseError
+	if errors.As(err, &closeErr) && closeErr.Code == wsd.CloseNormalClosure {
+		return 0
+	}
+	return 3
+}
+
+// runSession exchanges messages with the server until the connection is
+// closed, reporting whether we are done: the user closed it, be it by
+// interrupting us or through a command, or we received the -count messages
+// or the one to -expect.
+func runSession(ctx context.Context, client *wsd.Client, out <-chan inputLine) (finished bool) {
+	// We stop sending before closing the connection, but keep receiving
+	// until the server acknowledged the close.
+	receiving, stopReceiving := context.WithCancel(ctx)
+	sending, stopSending := context.WithCancel(receiving)
+	done := make(chan struct{})
+	closing := make(chan closeRequest)
 
 	wg.Add(1)
-	go inLoop(ws)
+	go inLoop(receiving, client, done, closing)
+	sendOnConnect(client)
+
+	// The goroutines sending messages, which we wait for before closing lest
+	// the close frame overtake the message they are sending.
+	var senders sync.WaitGroup
+	send := func(loop func()) {
+		wg.Add(1)
+		senders.Add(1)
+		go func() {
+			defer senders.Done()
+			loop()
+		}()
+	}
+	if streaming() {
+		send(func() { outLoop(sending, client, out, closing) })
+	}
+	if latencyInterval > 0 {
+		send(func() { latencyLoop(sending, client) })
+	}
+	if repeat != "" {
+		send(func() { repeatLoop(sending, client, closing) })
+	}
+	if replay != "" {
+		send(func() { replayLoop(sending, client, closing) })
+	}
+
+	request := userClose()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	case request = <-closing:
+		finished = true
+	}
+	if ctx.Err() != nil || gotAwaited() {
+		finished = true
+	}
+
+	stopSending()
+	senders.Wait()
+	if err := client.Close(request.code, request.reason); err != nil && finished {
+		printError(err)
+	}
+	stopReceiving()
 
 	wg.Wait()
+	if ndjson() && client.Err() == nil {
+		recordEvent(eventRecord{Event: "close", Code: request.code, Reason: request.reason})
+	}
+	return finished
 }
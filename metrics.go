@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// latencyBuckets are the upper bounds of the buckets of the latency
+// histogram, in seconds.
+var latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// serveMetrics serves the traffic stats in the Prometheus text format on
+// /metrics of addr, until the server returned is closed.
+func serveMetrics(addr string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	return server, nil
+}
+
+func writeMetrics(w io.Writer) {
+	metric := func(name, kind, help string, value int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+	}
+	metric("wsd_sent_messages_total", "counter", "Messages sent.", stats.sentMessages.Load())
+	metric("wsd_sent_bytes_total", "counter", "Bytes of the messages sent.", stats.sentBytes.Load())
+	metric("wsd_received_messages_total", "counter", "Messages received.", stats.receivedMessages.Load())
+	metric("wsd_received_bytes_total", "counter", "Bytes of the messages received.", stats.receivedBytes.Load())
+	metric("wsd_reconnections_total", "counter", "Successful reconnections.", stats.reconnections.Load())
+	connected := int64(0)
+	if stats.connected.Load() {
+		connected = 1
+	}
+	metric("wsd_connected", "gauge", "Whether we are connected to the server.", connected)
+
+	if latencyInterval > 0 {
+		writeLatencyHistogram(w)
+	}
+}
+
+func writeLatencyHistogram(w io.Writer) {
+	latency.mu.Lock()
+	defer latency.mu.Unlock()
+
+	const name = "wsd_latency_seconds"
+	fmt.Fprintf(w, "# HELP %s Round trip times of the -latency probes.\n# TYPE %s histogram\n", name, name)
+	counts := make([]int, len(latencyBuckets))
+	var sum float64
+	for _, rtt := range latency.samples {
+		seconds := rtt.Seconds()
+		sum += seconds
+		for i, bound := range latencyBuckets {
+			if seconds <= bound {
+				counts[i]++
+			}
+		}
+	}
+	for i, bound := range latencyBuckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, len(latency.samples))
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, sum, name, len(latency.samples))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/medvedev/wsd/wsd"
+)
+
+// messageRecord is the -output ndjson line of a message sent or received,
+// and the line of the -record transcripts.
+type messageRecord struct {
+	Time time.Time `json:"ts"`
+	Dir  string    `json:"dir"`
+	Type string    `json:"type"`
+	// Data is base64 encoded for binary messages.
+	Data string `json:"data"`
+}
+
+// eventRecord is the -output ndjson line of a connection event: open, close
+// or error.
+type eventRecord struct {
+	Time        time.Time `json:"ts"`
+	Event       string    `json:"event"`
+	URL         string    `json:"url,omitempty"`
+	Subprotocol string    `json:"subprotocol,omitempty"`
+	Code        int       `json:"code,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// recordMu keeps the lines of concurrent records from interleaving.
+var recordMu sync.Mutex
+
+// ndjson reports whether the output is made of JSON records rather than
+// text.
+func ndjson() bool {
+	return outputFormat == "ndjson"
+}
+
+func recordMessage(dir string, msg wsd.Message) {
+	writeRecord(newMessageRecord(dir, msg))
+}
+
+func newMessageRecord(dir string, msg wsd.Message) messageRecord {
+	record := messageRecord{Time: recordTime(), Dir: dir, Type: "text", Data: string(msg.Data)}
+	if msg.Type == wsd.BinaryMessage {
+		record.Type = "binary"
+		record.Data = base64.StdEncoding.EncodeToString(msg.Data)
+	}
+	return record
+}
+
+func recordEvent(record eventRecord) {
+	record.Time = recordTime()
+	writeRecord(record)
+}
+
+func recordTime() time.Time {
+	if utc {
+		return time.Now().UTC()
+	}
+	return time.Now()
+}
+
+func writeRecord(record any) {
+	// The records are made of strings and numbers, they always marshal.
+	line, _ := json.Marshal(record)
+
+	recordMu.Lock()
+	defer recordMu.Unlock()
+	stdout.Write(append(line, '\n'))
+}
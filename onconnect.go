@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"github.com/medvedev/wsd/wsd"
+)
+
+// onConnectLine is a line of the -onConnect file.
+type onConnectLine struct {
+	data   []byte
+	number int
+}
+
+// onConnectLines are the lines of the -onConnect file, read once.
+var onConnectLines []onConnectLine
+
+// loadOnConnect reads the lines of the -onConnect file, split on the
+// -delimiter like the input.
+func loadOnConnect(name string) ([]onConnectLine, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []onConnectLine
+	scanner := bufio.NewScanner(file)
+	if delimiter != nil {
+		scanner.Split(splitOn(delimiter))
+	}
+	for number := 1; scanner.Scan(); number++ {
+		lines = append(lines, onConnectLine{data: []byte(scanner.Text()), number: number})
+	}
+	return lines, scanner.Err()
+}
+
+// sendOnConnect sends the -onConnect lines to the server client just
+// connected to, before the input. The templates are expanded anew
+// on every connection.
+func sendOnConnect(client *wsd.Client) {
+	for _, line := range onConnectLines {
+		msg, err := newMessage(line.data)
+		if err != nil {
+			printError(fmt.Errorf("%s:%d: %w", onConnect, line.number, err))
+			continue
+		}
+		if verbose {
+			fmt.Fprintf(stderr, "\r* %s:%d\n", onConnect, line.number)
+		}
+		sendMessage(client, msg)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/medvedev/wsd/wsd"
+)
+
+// outputSyncInterval is how often the -outputFile is flushed to disk, so
+// that a crash loses at most that much of the messages received.
+const outputSyncInterval = time.Second
+
+// messageLog writes the messages received to the -outputFile.
+type messageLog struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+	stop chan struct{}
+}
+
+var output *messageLog
+
+// openOutput opens the -outputFile for appending, - meaning stdout.
+func openOutput(name string) (*messageLog, error) {
+	file := os.Stdout
+	if name != "-" {
+		var err error
+		file, err = os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	l := &messageLog{file: file, w: bufio.NewWriter(file), stop: make(chan struct{})}
+	go l.syncPeriodically()
+	return l, nil
+}
+
+// toStdout reports whether the messages are written to stdout, in which
+// case they replace the formatted output.
+func (l *messageLog) toStdout() bool {
+	return l.file == os.Stdout
+}
+
+// write appends msg followed by the -rawDelimiter with -raw, by a newline
+// otherwise.
+func (l *messageLog) write(msg wsd.Message) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch {
+	case raw:
+		l.w.Write(msg.Data)
+		l.w.Write(rawSeparator)
+	case dumped(msg):
+		l.w.WriteString(hex.Dump(msg.Data))
+	default:
+		l.w.Write(msg.Data)
+		l.w.WriteByte('\n')
+	}
+}
+
+func (l *messageLog) syncPeriodically() {
+	ticker := time.NewTicker(outputSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.sync()
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+func (l *messageLog) sync() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.w.Flush(); err != nil {
+		printError(err)
+		return
+	}
+	if !l.toStdout() {
+		l.file.Sync()
+	}
+}
+
+// close flushes what is left to write and closes the file.
+func (l *messageLog) close() {
+	close(l.stop)
+	l.sync()
+	if !l.toStdout() {
+		l.file.Close()
+	}
+}
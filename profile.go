@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// profileConfig is the content of the config file: profiles giving the
+// values of flags by name, lists giving the values of repeatable flags.
+//
+//	profiles:
+//	  prod:
+//	    url: wss://api.example.com/ws
+//	    token: $API_TOKEN
+//	    header:
+//	      - "X-Tenant: acme"
+type profileConfig struct {
+	Profiles map[string]map[string]any `yaml:"profiles"`
+}
+
+// configPath is the path of the config file, ~/.config/wsd/config.yaml on
+// Linux.
+func configPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "wsd", "config.yaml"), nil
+}
+
+// applyProfile sets the flags not given on the command line to their value
+// in the -profile.
+func applyProfile() error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("no config file at %s to read the profile %q from", path, profile)
+	}
+	if err != nil {
+		return err
+	}
+
+	var config profileConfig
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	values, ok := config.Profiles[profile]
+	if !ok {
+		var names []string
+		for name := range config.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("no profile %q in %s, expected one of %s", profile, path, strings.Join(names, ", "))
+	}
+
+	for name, value := range values {
+		if name == "profile" || flag.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown flag %q", profile, name)
+		}
+		// The URL argument counts as giving -url.
+		if isFlagSet(name) || name == "url" && urlArg != "" {
+			continue
+		}
+
+		list, ok := value.([]any)
+		if !ok {
+			list = []any{value}
+		}
+		for _, v := range list {
+			if err := flag.Set(name, fmt.Sprint(v)); err != nil {
+				return fmt.Errorf("%s: -%s: %w", profile, name, err)
+			}
+		}
+	}
+	return nil
+}
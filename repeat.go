@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/medvedev/wsd/wsd"
+)
+
+// repeated counts the -repeat messages sent, across reconnections.
+var repeated atomic.Int64
+
+// repeatLoop sends the -repeat message right away then every -interval,
+// until ctx is done or the -repeatCount messages are sent, in which case it
+// asks for the connection to be closed once the -grace period is over.
+func repeatLoop(ctx context.Context, client *wsd.Client, closing chan<- closeRequest) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(repeatInterval)
+	defer ticker.Stop()
+
+	for {
+		if repeatCount > 0 && repeated.Load() >= int64(repeatCount) {
+			waitForLateResponses(ctx, closing)
+			return
+		}
+		sent, err := newMessage([]byte(repeat))
+		if err != nil {
+			printError(err)
+			return
+		}
+		if err := sendTranscribed(client, sent); err != nil {
+			printError(err)
+		} else {
+			repeated.Add(1)
+			stats.countSent(sent)
+			printSentMessage(sent)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/medvedev/wsd/wsd"
+)
+
+// trafficStats counts the messages exchanged since we started, across
+// reconnections.
+type trafficStats struct {
+	start            time.Time
+	sentMessages     atomic.Int64
+	sentBytes        atomic.Int64
+	receivedMessages atomic.Int64
+	receivedBytes    atomic.Int64
+	reconnections    atomic.Int64
+	connected        atomic.Bool
+}
+
+var stats = trafficStats{start: time.Now()}
+
+func (s *trafficStats) countSent(msg wsd.Message) {
+	s.sentMessages.Add(1)
+	s.sentBytes.Add(int64(len(msg.Data)))
+}
+
+func (s *trafficStats) countReceived(msg wsd.Message) {
+	s.receivedMessages.Add(1)
+	s.receivedBytes.Add(int64(len(msg.Data)))
+}
+
+func printStats() {
+	fmt.Fprintf(os.Stderr, "\rsent %d msgs / %s, received %d msgs / %s, session %s\n",
+		stats.sentMessages.Load(), formatBytes(stats.sentBytes.Load()),
+		stats.receivedMessages.Load(), formatBytes(stats.receivedBytes.Load()),
+		formatDuration(time.Since(stats.start)))
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	value, prefix := float64(n)/unit, 0
+	for value >= unit && prefix < len("KMGT")-1 {
+		value /= unit
+		prefix++
+	}
+	return fmt.Sprintf("%.1f %cB", value, "KMGT"[prefix])
+}
+
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	return fmt.Sprintf("%02d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+}
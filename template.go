@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// templateFields are the fields the -template placeholders can refer to.
+type templateFields struct {
+	Seq       int64  // number of the message, from 1 on
+	Timestamp string // time the message is sent, in RFC 3339 format
+	UUID      string // random version 4 UUID
+}
+
+// templateSeq numbers the templated messages, across reconnections.
+var templateSeq atomic.Int64
+
+// parseTemplate parses text as the template of a message, failing on its
+// references to fields that don't exist too.
+func parseTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("message").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.Execute(io.Discard, templateFields{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// expandTemplate returns the message text templates, with its placeholders
+// replaced by the values of the message about to be sent.
+func expandTemplate(text []byte) ([]byte, error) {
+	tmpl, err := parseTemplate(string(text))
+	if err != nil {
+		return nil, err
+	}
+
+	fields := templateFields{
+		Seq:       templateSeq.Add(1),
+		Timestamp: time.Now().Format(time.RFC3339Nano),
+		UUID:      newUUID(),
+	}
+	var expanded bytes.Buffer
+	if err := tmpl.Execute(&expanded, fields); err != nil {
+		return nil, err
+	}
+	return expanded.Bytes(), nil
+}
+
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
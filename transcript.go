@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/medvedev/wsd/wsd"
+)
+
+// transcriptFile writes the -record transcript, made of the messageRecord
+// lines of -output ndjson.
+type transcriptFile struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+var transcript *transcriptFile
+
+func createTranscript(name string) (*transcriptFile, error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &transcriptFile{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+// transcribe adds msg to the -record transcript, if any.
+func transcribe(dir string, msg wsd.Message) {
+	if transcript == nil {
+		return
+	}
+
+	transcript.mu.Lock()
+	defer transcript.mu.Unlock()
+	if err := transcript.enc.Encode(newMessageRecord(dir, msg)); err != nil {
+		printError(err)
+	}
+}
+
+// sendTranscribed sends msg, adding it to the -record transcript first for
+// its response not to be transcribed before it. Without holding the lock
+// while sending, lest a server slow to read block the receiving too: a
+// message failing to be sent stays in the transcript.
+func sendTranscribed(client *wsd.Client, msg wsd.Message) error {
+	transcribe("sent", msg)
+	return client.Send(msg)
+}
+
+func (t *transcriptFile) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.file.Close()
+}
+
+// replayedMessage is a message of the -replay transcript, sent delay after
+// the previous one.
+type replayedMessage struct {
+	delay time.Duration
+	msg   wsd.Message
+}
+
+var replayMessages []replayedMessage
+
+// replayed counts the -replay messages sent, across reconnections.
+var replayed atomic.Int64
+
+// loadReplay reads the messages sent of the transcript in the file name,
+// with their delays scaled down by the -speed.
+func loadReplay(name string) ([]replayedMessage, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var messages []replayedMessage
+	var last time.Time
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var record messageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		// Events and the messages received are not replayed.
+		if record.Dir != "sent" {
+			continue
+		}
+
+		msg := wsd.Message{Type: wsd.TextMessage, Data: []byte(record.Data)}
+		switch record.Type {
+		case "text":
+		case "binary":
+			msg.Type = wsd.BinaryMessage
+			if msg.Data, err = base64.StdEncoding.DecodeString(record.Data); err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+		default:
+			return nil, fmt.Errorf("line %d: unknown message type %q", line, record.Type)
+		}
+
+		var delay time.Duration
+		if !last.IsZero() && speed > 0 {
+			delay = time.Duration(float64(record.Time.Sub(last)) / speed)
+		}
+		last = record.Time
+		messages = append(messages, replayedMessage{delay: max(delay, 0), msg: msg})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// replayLoop sends the -replay messages at their recorded pace, then asks
+// for the connection to be closed once the -grace period is over. Should the
+// connection drop, the next one resumes where this one stopped.
+func replayLoop(ctx context.Context, client *wsd.Client, closing chan<- closeRequest) {
+	defer wg.Done()
+
+	for {
+		i := int(replayed.Load())
+		if i == len(replayMessages) {
+			waitForLateResponses(ctx, closing)
+			return
+		}
+
+		next := replayMessages[i]
+		if i > 0 {
+			select {
+			case <-time.After(next.delay):
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := sendTranscribed(client, next.msg); err != nil {
+			printError(err)
+			return
+		}
+		replayed.Add(1)
+		stats.countSent(next.msg)
+		printSentMessage(next.msg)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/medvedev/wsd/wsd"
+)
+
+// logRedirect logs the redirections followed with -verbose.
+func logRedirect(resp *http.Response, location string) {
+	if verbose {
+		fmt.Fprintf(stderr, "* redirected by %s %s to %s\n", resp.Proto, resp.Status, location)
+	}
+}
+
+// printTiming prints the breakdown of -timing, the way curl -w does.
+func printTiming(t wsd.Timing) {
+	total := t.DNS + t.Connect + t.TLS + t.Upgrade
+	fmt.Fprintf(stderr, "dns: %v, connect: %v, tls: %v, upgrade: %v, total: %v\n",
+		roundTiming(t.DNS), roundTiming(t.Connect), roundTiming(t.TLS), roundTiming(t.Upgrade), roundTiming(total))
+}
+
+func roundTiming(d time.Duration) time.Duration {
+	return d.Round(10 * time.Microsecond)
+}
+
+// logPing logs the pings received with -verbose.
+func logPing(payload []byte) {
+	fmt.Fprintf(stderr, "\r* ping received: %q\n", payload)
+	printPrompt()
+}
+
+// logPong logs the pongs received with -verbose.
+func logPong(payload []byte) {
+	fmt.Fprintf(stderr, "\r* pong received: %q\n", payload)
+	printPrompt()
+}
+
+// logHandshake logs to stderr as much of the handshake of client as
+// happened, the way curl -v does: TLS details prefixed by *, what we sent by
+// > and what we received by <.
+func logHandshake(client *wsd.Client) {
+	if state := client.TLSState(); state != nil {
+		fmt.Fprintf(stderr, "* %s, %s\n", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+		if state.NegotiatedProtocol != "" {
+			fmt.Fprintf(stderr, "* ALPN: %s\n", state.NegotiatedProtocol)
+		} else if alpn != "" {
+			fmt.Fprintln(stderr, "* ALPN: none accepted by the server")
+		}
+		if len(state.PeerCertificates) > 0 {
+			cert := state.PeerCertificates[0]
+			fmt.Fprintf(stderr, "* subject: %s\n", cert.Subject)
+			fmt.Fprintf(stderr, "* issuer: %s\n", cert.Issuer)
+		}
+	}
+
+	if req := client.Request(); req != nil {
+		fmt.Fprintf(stderr, "> %s %s %s\n", req.Method, req.RequestURI, req.Proto)
+		fmt.Fprintf(stderr, "> Host: %s\n", req.Host)
+		logHeader(">", req.Header)
+	}
+
+	resp := client.Response()
+	if resp == nil {
+		return
+	}
+	fmt.Fprintf(stderr, "< %s %s\n", resp.Proto, resp.Status)
+	logHeader("<", resp.Header)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return
+	}
+
+	if protocol := resp.Header.Get("Sec-WebSocket-Protocol"); protocol != "" {
+		fmt.Fprintf(stderr, "* subprotocol: %s\n", protocol)
+	} else {
+		fmt.Fprintln(stderr, "* subprotocol: none")
+	}
+	if extensions := resp.Header.Get("Sec-WebSocket-Extensions"); extensions != "" {
+		fmt.Fprintf(stderr, "* extensions: %s\n", extensions)
+	} else {
+		fmt.Fprintln(stderr, "* extensions: none")
+	}
+	if compress {
+		if deflating(resp.Header) {
+			fmt.Fprintln(stderr, "* compression: accepted")
+		} else {
+			fmt.Fprintln(stderr, "* compression: declined by the server")
+		}
+	}
+}
+
+// deflating reports whether the server accepted the permessage-deflate
+// extension in the handshake response header.
+func deflating(header http.Header) bool {
+	for _, extensions := range header.Values("Sec-WebSocket-Extensions") {
+		for _, extension := range strings.Split(extensions, ",") {
+			name, _, _ := strings.Cut(extension, ";")
+			if strings.TrimSpace(name) == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func logHeader(prefix string, header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, value := range header[name] {
+			fmt.Fprintf(stderr, "%s %s: %s\n", prefix, name, value)
+		}
+	}
+	fmt.Fprintln(stderr, prefix)
+}
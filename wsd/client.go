@@ -0,0 +1,403 @@
+// Package wsd implements the WebSocket client behind the wsd command, for
+// programs that want to debug WebSocket servers the same way.
+package wsd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Status codes of close frames.
+const (
+	// CloseNormalClosure closes a connection normally.
+	CloseNormalClosure = 1000
+	// CloseNoStatusReceived is reported for close frames without a status.
+	CloseNoStatusReceived = 1005
+	// CloseAbnormalClosure is the status conventionally reported for
+	// connections dropped without a close frame, which Err reports as io.EOF.
+	CloseAbnormalClosure = 1006
+	// CloseInvalidFramePayloadData closes a connection that received a
+	// message inconsistent with its type, like invalid UTF-8 text.
+	CloseInvalidFramePayloadData = 1007
+	// CloseMessageTooBig closes a connection that received a message larger
+	// than the MaxMessageSize.
+	CloseMessageTooBig = 1009
+)
+
+// maxCloseReason is the length of the longest reason that fits in a close
+// frame along with its status code.
+const maxCloseReason = 123
+
+// closeTimeout bounds how long Close waits for the server to acknowledge a
+// close frame before dropping the connection.
+const closeTimeout = 2 * time.Second
+
+// ErrBadStatus is returned by Connect when the server answers the handshake
+// with another status than 101 Switching Protocols, or with a response that
+// doesn't complete the upgrade.
+var ErrBadStatus = websocket.ErrBadHandshake
+
+// ErrBadScheme is returned, wrapped, by Connect for URLs that are neither
+// ws:// nor wss://.
+var ErrBadScheme = errors.New("bad scheme")
+
+// ErrIdleTimeout ends connections that received no message for the
+// IdleTimeout.
+var ErrIdleTimeout = errors.New("no message received within the idle timeout")
+
+// ErrMessageTooBig ends connections that received a message larger than the
+// MaxMessageSize.
+var ErrMessageTooBig = errors.New("message too big")
+
+// Config describes how to connect to a WebSocket server.
+type Config struct {
+	// URL is the ws:// or wss:// address of the server.
+	URL string
+	// Origin is sent in the Origin header of the handshake, the header is
+	// omitted when empty.
+	Origin string
+	// Protocols are the subprotocols offered to the server.
+	Protocols []string
+	// Header holds additional headers sent with the handshake.
+	Header http.Header
+	// Proxy is the http:// or socks5:// URL of the proxy to connect through,
+	// nil connects directly.
+	Proxy *url.URL
+	// UnixSocket is the path of the Unix socket to connect to instead of the
+	// host of the URL, which remains the host of the handshake. Proxy is
+	// ignored then.
+	UnixSocket string
+	// LocalAddr is the local address to connect from, nil lets the system
+	// choose.
+	LocalAddr *net.TCPAddr
+	// Resolve maps host names to the address to connect to in their stead,
+	// as ip or ip:port. The host name is still used for the Host header and
+	// to verify the certificate.
+	Resolve map[string]string
+	// TCPKeepAlive is the interval between the TCP keepalive probes, zero
+	// keeps the default of net.Dialer, 15 seconds, and a negative interval
+	// disables them.
+	TCPKeepAlive time.Duration
+	// Nagle enables Nagle's algorithm on TCP connections, buffering the
+	// small frames we send. Go disables it by default, sending them right
+	// away as TCP_NODELAY does.
+	Nagle bool
+	// TLSConfig is used for wss:// connections.
+	TLSConfig *tls.Config
+	// PingInterval is the interval between the ping frames sent to keep the
+	// connection alive, zero disables pings.
+	PingInterval time.Duration
+	// PingPayload is the payload of the pings sent every PingInterval, of
+	// 125 bytes at most.
+	PingPayload []byte
+	// IgnorePings leaves the pings of the server unanswered rather than
+	// answering them with a pong.
+	IgnorePings bool
+	// IdleTimeout ends the connection with ErrIdleTimeout when no message
+	// is received for that long, zero waits forever.
+	IdleTimeout time.Duration
+	// Compression offers the permessage-deflate extension to the server,
+	// messages are compressed if it accepts it.
+	Compression bool
+	// MaxMessageSize is the size in bytes of the largest message accepted,
+	// zero accepts any. The connection is closed with CloseMessageTooBig as
+	// soon as the header of a frame exceeding it is read, and Err reports
+	// ErrMessageTooBig.
+	MaxMessageSize int64
+	// MaxRedirects is the number of redirections of the handshake to follow
+	// to other ws:// or wss:// URLs, zero follows none. Redirections from
+	// wss:// to ws:// are refused, and the Authorization and Cookie headers
+	// are only sent to the host of the URL.
+	MaxRedirects int
+	// Jar, if not nil, keeps the cookies set by the handshake responses to
+	// send them with the next handshake requests, redirections included.
+	Jar http.CookieJar
+	// OnRedirect is called with the response redirecting the handshake to
+	// location, before following it.
+	OnRedirect func(resp *http.Response, location string)
+	// OnPong is called with the payload of the pongs received, from the
+	// goroutine receiving messages: it must not block.
+	OnPong func(payload []byte)
+	// OnPing is called with the payload of the pings received, from the
+	// goroutine receiving messages: it must not block.
+	OnPing func(payload []byte)
+}
+
+// MessageType is the type of a data message.
+type MessageType int
+
+// The types of data messages.
+const (
+	TextMessage MessageType = iota
+	BinaryMessage
+)
+
+// Message is a data message exchanged with the server.
+type Message struct {
+	Type MessageType
+	Data []byte
+}
+
+// Timing is how long the phases of the last connection attempt took, zero
+// for the phases that didn't happen.
+type Timing struct {
+	// DNS is the resolution of the host of the server, or of the proxy.
+	DNS time.Duration
+	// Connect is the TCP connection, through the proxy if any.
+	Connect time.Duration
+	// TLS is the TLS handshake of wss:// connections.
+	TLS time.Duration
+	// Upgrade is the WebSocket handshake.
+	Upgrade time.Duration
+}
+
+// Client is a connection to a WebSocket server.
+type Client struct {
+	config   Config
+	url      string
+	conn     *websocket.Conn
+	request  *http.Request
+	response *http.Response
+	tlsState *tls.ConnectionState
+	timing   Timing
+	messages chan Message
+	err      error
+
+	// sendMu serializes the data messages, websocket.Conn supports a single
+	// writer at a time.
+	sendMu sync.Mutex
+
+	// done is closed once the server stops sending us messages, stop once
+	// we don't want to hear from it anymore.
+	done      chan struct{}
+	stop      chan struct{}
+	closing   atomic.Bool
+	closeOnce sync.Once
+}
+
+// NewClient returns a client that will connect as described by config.
+func NewClient(config Config) *Client {
+	return &Client{
+		config:   config,
+		url:      config.URL,
+		messages: make(chan Message),
+		done:     make(chan struct{}),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Connect connects to the server and starts receiving messages from it.
+// Cancelling ctx aborts the connection attempt, it has no effect once
+// connected: use Close to end the connection.
+func (c *Client) Connect(ctx context.Context) error {
+	if err := c.dialFollowingRedirects(ctx); err != nil {
+		return err
+	}
+
+	go c.readLoop()
+	if c.config.PingInterval > 0 {
+		go c.pingLoop()
+	}
+	return nil
+}
+
+// URL returns the URL of the server, the one of the Config unless the
+// handshake was redirected.
+func (c *Client) URL() string {
+	return c.url
+}
+
+// Request returns the handshake request sent to the server. After a failed
+// Connect, it is nil unless the request was sent.
+func (c *Client) Request() *http.Request {
+	return c.request
+}
+
+// Response returns the response of the server to the handshake. After a
+// failed Connect, it is nil unless the server answered.
+func (c *Client) Response() *http.Response {
+	return c.response
+}
+
+// TLSState returns the state of the TLS connection, nil for ws:// URLs or
+// when Connect failed before the TLS handshake completed.
+func (c *Client) TLSState() *tls.ConnectionState {
+	return c.tlsState
+}
+
+// Timing returns how long the phases of Connect took, for as much of it as
+// happened.
+func (c *Client) Timing() Timing {
+	return c.timing
+}
+
+// Subprotocol returns the subprotocol selected by the server, if any.
+func (c *Client) Subprotocol() string {
+	return c.conn.Subprotocol()
+}
+
+// Messages returns the channel the messages received are delivered on. It
+// is closed when the connection ends, Err then tells why.
+func (c *Client) Messages() <-chan Message {
+	return c.messages
+}
+
+// Err returns the error that ended the connection once Messages is closed.
+// It is a *CloseError if the server closed the connection with a close
+// frame, io.EOF if it dropped it, and nil if we closed it.
+func (c *Client) Err() error {
+	return c.err
+}
+
+// Send sends msg to the server.
+func (c *Client) Send(msg Message) error {
+	messageType := websocket.TextMessage
+	if msg.Type == BinaryMessage {
+		messageType = websocket.BinaryMessage
+	}
+
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	return c.conn.WriteMessage(messageType, msg.Data)
+}
+
+// Ping sends a ping frame with the given payload.
+func (c *Client) Ping(payload []byte) error {
+	return c.conn.WriteControl(websocket.PingMessage, payload, time.Time{})
+}
+
+// Close closes the connection with the given status code and reason. Unless
+// the server closed the connection already, it waits for it to acknowledge
+// the close frame, for a couple of seconds at most. Reasons too long for a
+// close frame are truncated.
+func (c *Client) Close(code int, reason string) error {
+	reason = truncateReason(reason)
+
+	var err error
+	c.closeOnce.Do(func() {
+		c.closing.Store(true)
+
+		message := websocket.FormatCloseMessage(code, reason)
+		deadline := time.Now().Add(closeTimeout)
+		select {
+		case <-c.done:
+			// websocket.Conn answered the close frame of the server if any,
+			// in which case it refuses to send another one.
+			c.conn.WriteControl(websocket.CloseMessage, message, deadline)
+			err = c.conn.Close()
+		default:
+			err = c.conn.WriteControl(websocket.CloseMessage, message, deadline)
+
+			select {
+			case <-c.done:
+			case <-time.After(closeTimeout):
+			}
+			c.conn.Close()
+		}
+
+		close(c.stop)
+	})
+	return err
+}
+
+func (c *Client) readLoop() {
+	defer close(c.messages)
+	defer close(c.done)
+
+	for {
+		if c.config.IdleTimeout > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.config.IdleTimeout))
+		}
+
+		messageType, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if !c.closing.Load() {
+				c.err = readError(err, c.config.IdleTimeout > 0)
+			}
+			return
+		}
+
+		msg := Message{Type: TextMessage, Data: data}
+		if messageType == websocket.BinaryMessage {
+			msg.Type = BinaryMessage
+		}
+
+		select {
+		case c.messages <- msg:
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// truncateReason cuts reason to the maxCloseReason bytes a close frame can
+// hold, without splitting a UTF-8 sequence.
+func truncateReason(reason string) string {
+	if len(reason) > maxCloseReason {
+		reason = strings.ToValidUTF8(reason[:maxCloseReason], "")
+	}
+	return reason
+}
+
+// readError translates the errors of websocket.Conn into the ones documented
+// by Err.
+func readError(err error, idleTimeout bool) error {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		if closeErr.Code == websocket.CloseAbnormalClosure {
+			// websocket.Conn reports dropped connections this way.
+			return io.EOF
+		}
+		return &CloseError{Code: closeErr.Code, Text: closeErr.Text}
+	}
+	if err == websocket.ErrReadLimit {
+		return ErrMessageTooBig
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() && idleTimeout {
+		return ErrIdleTimeout
+	}
+	return err
+}
+
+// pingLoop sends a ping frame every PingInterval. The pongs are handled by
+// the pong handler of websocket.Conn without ever being handed to readLoop,
+// and failing to send a ping is left for readLoop to notice.
+func (c *Client) pingLoop() {
+	ticker := time.NewTicker(c.config.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.Ping(c.config.PingPayload)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// CloseError is the error of a connection the server closed with a close
+// frame.
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	if e.Text == "" {
+		return fmt.Sprintf("close status %d", e.Code)
+	}
+	return fmt.Sprintf("close status %d (%s)", e.Code, e.Text)
+}
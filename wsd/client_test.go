@@ -0,0 +1,62 @@
+package wsd
+
+import (
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestReadError(t *testing.T) {
+	other := errors.New("other")
+	tests := []struct {
+		name        string
+		err         error
+		idleTimeout bool
+		want        error
+	}{
+		{"dropped", &websocket.CloseError{Code: websocket.CloseAbnormalClosure}, false, io.EOF},
+		{"closed", &websocket.CloseError{Code: websocket.CloseNormalClosure, Text: "bye"}, false, &CloseError{Code: CloseNormalClosure, Text: "bye"}},
+		{"too big", websocket.ErrReadLimit, false, ErrMessageTooBig},
+		{"idle", os.ErrDeadlineExceeded, true, ErrIdleTimeout},
+		{"timeout without idle timeout", os.ErrDeadlineExceeded, false, os.ErrDeadlineExceeded},
+		{"other", other, true, other},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readError(tt.err, tt.idleTimeout); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readError(%v) = %#v, want %#v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruncateReason(t *testing.T) {
+	tests := []struct {
+		name   string
+		reason string
+		want   string
+	}{
+		{"short", "bye", "bye"},
+		{"limit", strings.Repeat("a", maxCloseReason), strings.Repeat("a", maxCloseReason)},
+		{"long", strings.Repeat("a", maxCloseReason+10), strings.Repeat("a", maxCloseReason)},
+		// é is 2 bytes: the one straddling the limit goes.
+		{"multibyte", "a" + strings.Repeat("é", maxCloseReason), "a" + strings.Repeat("é", (maxCloseReason-1)/2)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateReason(tt.reason)
+			if got != tt.want {
+				t.Errorf("truncateReason() = %q, want %q", got, tt.want)
+			}
+			if len(got) > maxCloseReason || !utf8.ValidString(got) {
+				t.Errorf("truncateReason() = %q, not a valid close reason", got)
+			}
+		})
+	}
+}
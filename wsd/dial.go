@@ -0,0 +1,345 @@
+package wsd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/proxy"
+)
+
+// dial connects to the WebSocket server at rawURL. It dials the connection itself,
+// rather than leaving it to websocket.Dialer, to go through our proxies and
+// to get hold of the handshake. The request, the response and the TLS state
+// are kept even when the handshake fails, for as much of it as happened.
+func (c *Client) dial(ctx context.Context, rawURL string) error {
+	location, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	addr, err := serverAddress(location)
+	if err != nil {
+		return err
+	}
+	addr = resolveAddress(addr, c.config.Resolve)
+
+	// Neither the proxy tunnel, nor the TLS handshake, nor websocket.Dialer
+	// past the dial know of ctx, interrupt them by expiring the deadline of
+	// the connection should ctx be done before the handshake.
+	handshakeDone := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	var conn *recordingConn
+	var upgradeStart time.Time
+	c.timing = Timing{}
+	netDial := func(_ context.Context, _, _ string) (net.Conn, error) {
+		start := time.Now()
+		var resolved time.Time
+		netConn, err := dialConn(ctx, addr, c.config, func() {
+			if resolved.IsZero() {
+				resolved = time.Now()
+			}
+		})
+		if resolved.IsZero() {
+			// No name to resolve, or we failed to.
+			resolved = time.Now()
+		}
+		c.timing.DNS = resolved.Sub(start)
+		c.timing.Connect = time.Since(resolved)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			select {
+			case <-ctx.Done():
+				netConn.SetDeadline(time.Now())
+				interrupted <- true
+			case <-handshakeDone:
+				interrupted <- false
+			}
+		}()
+
+		conn = &recordingConn{recording: true}
+		conn.Conn, err = secure(netConn, location, addr, c.config, &c.timing)
+		if tlsConn, ok := conn.Conn.(*tls.Conn); ok {
+			state := tlsConn.ConnectionState()
+			c.tlsState = &state
+		}
+		if err != nil {
+			netConn.Close()
+			return nil, err
+		}
+		upgradeStart = time.Now()
+		return conn, nil
+	}
+	dialer, header := c.newDialer(netDial)
+	if redirected, err := url.Parse(c.config.URL); err == nil && redirected.Host != location.Host {
+		// Like net/http, keep the credentials of the server for itself.
+		header.Del("Authorization")
+		header.Del("Cookie")
+	}
+
+	// The deadline of ctx is enforced by the goroutine above, websocket.Dialer
+	// would override it with its own.
+	ws, resp, err := dialer.DialContext(context.Background(), rawURL, header)
+	close(handshakeDone)
+	if !upgradeStart.IsZero() {
+		c.timing.Upgrade = time.Since(upgradeStart)
+	}
+	if conn != nil && <-interrupted {
+		err = ctx.Err()
+	}
+	c.response = resp
+	if conn != nil {
+		conn.recording = false
+		c.request, _ = http.ReadRequest(bufio.NewReader(&conn.sent))
+	}
+	if err != nil {
+		if ws != nil {
+			ws.Close()
+		}
+		return err
+	}
+
+	if c.config.MaxMessageSize > 0 {
+		ws.SetReadLimit(c.config.MaxMessageSize)
+	}
+	if c.config.OnPong != nil {
+		ws.SetPongHandler(func(payload string) error {
+			c.config.OnPong([]byte(payload))
+			return nil
+		})
+	}
+	if c.config.OnPing != nil || c.config.IgnorePings {
+		ws.SetPingHandler(func(payload string) error {
+			if c.config.OnPing != nil {
+				c.config.OnPing([]byte(payload))
+			}
+			if c.config.IgnorePings {
+				return nil
+			}
+			// As the default handler does.
+			err := ws.WriteControl(websocket.PongMessage, []byte(payload), time.Now().Add(time.Second))
+			if err == websocket.ErrCloseSent {
+				return nil
+			}
+			return err
+		})
+	}
+	c.conn = ws
+	return nil
+}
+
+// newDialer returns the dialer doing the handshake over the connections
+// returned by netDial, along with the headers to send.
+func (c *Client) newDialer(netDial func(ctx context.Context, network, addr string) (net.Conn, error)) (*websocket.Dialer, http.Header) {
+	header := http.Header{}
+	for key, values := range c.config.Header {
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+	if c.config.Origin != "" {
+		header.Set("Origin", c.config.Origin)
+	}
+	if _, ok := header["User-Agent"]; !ok {
+		// Rather than the default User-Agent of net/http.
+		header["User-Agent"] = []string{""}
+	}
+
+	dialer := &websocket.Dialer{
+		NetDialContext:    netDial,
+		NetDialTLSContext: netDial,
+		Subprotocols:      c.config.Protocols,
+		EnableCompression: c.config.Compression,
+		Jar:               c.config.Jar,
+	}
+	return dialer, header
+}
+
+// HandshakeRequest returns the request Connect would send to the server,
+// without connecting to it.
+func (c *Client) HandshakeRequest() (*http.Request, error) {
+	location, err := url.Parse(c.config.URL)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := serverAddress(location); err != nil {
+		return nil, err
+	}
+
+	// Let websocket.Dialer write the request to a pipe rather than to the
+	// server, and hang up on it once read.
+	conn, server := net.Pipe()
+	dialer, header := c.newDialer(func(context.Context, string, string) (net.Conn, error) {
+		return conn, nil
+	})
+	dialed := make(chan error, 1)
+	go func() {
+		_, _, err := dialer.DialContext(context.Background(), c.config.URL, header)
+		// Unblocks the read below if it failed before writing the request.
+		conn.Close()
+		dialed <- err
+	}()
+
+	req, err := http.ReadRequest(bufio.NewReader(server))
+	server.Close()
+	if dialErr := <-dialed; req == nil && dialErr != nil {
+		return nil, dialErr
+	}
+	return req, err
+}
+
+// dialConn opens the connection to the server, or to the HTTP proxy if any.
+// SOCKS proxies take care of connecting us to the server themselves.
+func dialConn(ctx context.Context, addr string, config Config, resolved func()) (net.Conn, error) {
+	var err error
+	dialer := &net.Dialer{
+		KeepAlive: config.TCPKeepAlive,
+		// Called once the address is resolved, before connecting.
+		ControlContext: func(context.Context, string, string, syscall.RawConn) error {
+			resolved()
+			return nil
+		},
+	}
+	if config.LocalAddr != nil {
+		dialer.LocalAddr = config.LocalAddr
+	}
+	proxyURL := config.Proxy
+	switch {
+	case config.UnixSocket != "":
+		// Nothing to resolve.
+		resolved()
+		return dialer.DialContext(ctx, "unix", config.UnixSocket)
+	case proxyURL == nil:
+	case isSOCKS(proxyURL):
+		socks, err := proxy.FromURL(proxyURL, dialer)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := socks.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+		return withNagle(conn, err, config.Nagle)
+	default:
+		if addr, err = proxyAddress(proxyURL); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	return withNagle(conn, err, config.Nagle)
+}
+
+// withNagle enables Nagle's algorithm on the TCP connection conn if nagle,
+// Go disabling it by default.
+func withNagle(conn net.Conn, err error, nagle bool) (net.Conn, error) {
+	if err != nil || !nagle {
+		return conn, err
+	}
+	if tcpConn, ok := conn.(interface{ SetNoDelay(bool) error }); ok {
+		if err := tcpConn.SetNoDelay(false); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// resolveAddress returns the address addr resolves to according to
+// resolve, addr itself if its host isn't overridden.
+func resolveAddress(addr string, resolve map[string]string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	override, ok := resolve[strings.ToLower(host)]
+	if !ok {
+		return addr
+	}
+	if _, _, err := net.SplitHostPort(override); err == nil {
+		return override
+	}
+	return net.JoinHostPort(override, port)
+}
+
+// serverAddress returns the host:port of the server at location.
+func serverAddress(location *url.URL) (string, error) {
+	port := location.Port()
+	switch location.Scheme {
+	case "ws":
+		if port == "" {
+			port = "80"
+		}
+	case "wss":
+		if port == "" {
+			port = "443"
+		}
+	case "http", "https":
+		suggestion := *location
+		suggestion.Scheme = strings.Replace(location.Scheme, "http", "ws", 1)
+		return "", fmt.Errorf("%w %s://, did you mean %s?", ErrBadScheme, location.Scheme, &suggestion)
+	default:
+		if location.Scheme == "" || location.Opaque != "" {
+			return "", fmt.Errorf("%w, expected a ws:// or wss:// URL", ErrBadScheme)
+		}
+		return "", fmt.Errorf("%w %s://, expected ws:// or wss://", ErrBadScheme, location.Scheme)
+	}
+	return net.JoinHostPort(location.Hostname(), port), nil
+}
+
+// secure turns conn into the connection over which the WebSocket handshake
+// will happen: it tunnels through the proxy if any, then secures the
+// connection with TLS for wss URLs.
+func secure(conn net.Conn, location *url.URL, addr string, config Config, timing *Timing) (net.Conn, error) {
+	if config.Proxy != nil && !isSOCKS(config.Proxy) {
+		start := time.Now()
+		var err error
+		conn, err = tunnel(conn, config.Proxy, addr)
+		timing.Connect += time.Since(start)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if location.Scheme != "wss" {
+		return conn, nil
+	}
+
+	tlsConfig := config.TLSConfig.Clone()
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = location.Hostname()
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	start := time.Now()
+	err := tlsConn.Handshake()
+	timing.TLS = time.Since(start)
+	if err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// recordingConn keeps a copy of what is written to the connection while
+// recording, so that we can look at the handshake request once
+// websocket.Dialer is done with it.
+type recordingConn struct {
+	net.Conn
+	recording bool
+	sent      bytes.Buffer
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	if c.recording {
+		c.sent.Write(p)
+	}
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,68 @@
+package wsd
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestResolveAddress(t *testing.T) {
+	resolve := map[string]string{
+		"example.com": "127.0.0.1",
+		"api.test":    "10.0.0.1:8443",
+		"v6.test":     "::1",
+	}
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"example.com:80", "127.0.0.1:80"},
+		{"EXAMPLE.com:443", "127.0.0.1:443"},
+		{"api.test:443", "10.0.0.1:8443"},
+		{"v6.test:80", "[::1]:80"},
+		{"other.test:80", "other.test:80"},
+		{"no-port", "no-port"},
+	}
+	for _, tt := range tests {
+		if got := resolveAddress(tt.addr, resolve); got != tt.want {
+			t.Errorf("resolveAddress(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestServerAddress(t *testing.T) {
+	tests := []struct {
+		url     string
+		want    string
+		wantErr string
+	}{
+		{url: "ws://example.com/ws", want: "example.com:80"},
+		{url: "wss://example.com/ws", want: "example.com:443"},
+		{url: "ws://example.com:1337/ws", want: "example.com:1337"},
+		{url: "wss://[::1]:8443/", want: "[::1]:8443"},
+		{url: "http://example.com/ws", wantErr: "bad scheme http://, did you mean ws://example.com/ws?"},
+		{url: "https://example.com:8443/ws?a=b", wantErr: "bad scheme https://, did you mean wss://example.com:8443/ws?a=b?"},
+		{url: "ftp://example.com/", wantErr: "bad scheme ftp://, expected ws:// or wss://"},
+		{url: "example.com/ws", wantErr: "bad scheme, expected a ws:// or wss:// URL"},
+		{url: "localhost:1337", wantErr: "bad scheme, expected a ws:// or wss:// URL"},
+	}
+	for _, tt := range tests {
+		location, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := serverAddress(location)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("serverAddress(%q) error = %v, want %q", tt.url, err, tt.wantErr)
+			}
+			if !errors.Is(err, ErrBadScheme) {
+				t.Errorf("serverAddress(%q) error = %v, want ErrBadScheme", tt.url, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("serverAddress(%q) = %q, %v, want %q", tt.url, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package wsd
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// isSOCKS reports whether proxy is a SOCKS proxy rather than an HTTP one.
+func isSOCKS(proxy *url.URL) bool {
+	return proxy.Scheme == "socks5" || proxy.Scheme == "socks5h"
+}
+
+// proxyAddress returns the host:port to dial to reach the HTTP proxy.
+func proxyAddress(proxy *url.URL) (string, error) {
+	if proxy.Scheme != "http" {
+		return "", fmt.Errorf("unsupported proxy scheme %q", proxy.Scheme)
+	}
+	if proxy.Port() == "" {
+		return net.JoinHostPort(proxy.Hostname(), "80"), nil
+	}
+	return proxy.Host, nil
+}
+
+// tunnel asks the proxy at the other end of conn to connect us to addr,
+// authenticating with the credentials of the proxy URL if any.
+func tunnel(conn net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if user := proxy.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &ProxyError{Status: resp.Status}
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// ProxyError is returned by Connect when the proxy refuses to connect us to
+// the server.
+type ProxyError struct {
+	Status string
+}
+
+func (e *ProxyError) Error() string {
+	return "proxy answered " + e.Status
+}
+
+// bufferedConn reads what the proxy sent past its response before reading
+// from the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
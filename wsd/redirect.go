@@ -0,0 +1,69 @@
+package wsd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// ErrTooManyRedirects is returned by Connect when the handshake is still
+// redirected after MaxRedirects redirections.
+var ErrTooManyRedirects = errors.New("too many redirects")
+
+// dialFollowingRedirects dials the URL of the Config, then the locations it
+// redirects to up to MaxRedirects times.
+func (c *Client) dialFollowingRedirects(ctx context.Context) error {
+	for redirects := 0; ; redirects++ {
+		err := c.dial(ctx, c.url)
+		if err != ErrBadStatus || c.config.MaxRedirects == 0 || !isRedirect(c.response) {
+			return err
+		}
+		if redirects == c.config.MaxRedirects {
+			return fmt.Errorf("%w: still redirected after %d", ErrTooManyRedirects, redirects)
+		}
+
+		location, err := redirectLocation(c.url, c.response)
+		if err != nil {
+			return err
+		}
+		if c.config.OnRedirect != nil {
+			c.config.OnRedirect(c.response, location)
+		}
+		c.url = location
+		c.request, c.response, c.tlsState = nil, nil, nil
+	}
+}
+
+func isRedirect(resp *http.Response) bool {
+	if resp == nil {
+		return false
+	}
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// redirectLocation returns the URL resp redirects the handshake with the
+// server at from to, refusing to go from wss:// to ws://.
+func redirectLocation(from string, resp *http.Response) (string, error) {
+	base, err := url.Parse(from)
+	if err != nil {
+		return "", err
+	}
+	// Rather than resp.Location, which resolves it against the http:// URL
+	// websocket.Dialer requested.
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.Header.Get("Location") == "" {
+		return "", fmt.Errorf("redirect without a valid Location header")
+	}
+	location = base.ResolveReference(location)
+	if base.Scheme == "wss" && location.Scheme == "ws" {
+		return "", fmt.Errorf("refusing to follow the redirect from %s to %s, which isn't secure", from, location)
+	}
+	return location.String(), nil
+}
@@ -0,0 +1,40 @@
+package wsd
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRedirectLocation(t *testing.T) {
+	tests := []struct {
+		from     string
+		location string
+		want     string
+		wantErr  bool
+	}{
+		{from: "ws://example.com/old", location: "/new", want: "ws://example.com/new"},
+		{from: "wss://example.com/a/old", location: "new?x=1", want: "wss://example.com/a/new?x=1"},
+		{from: "ws://example.com/", location: "wss://other.test/ws", want: "wss://other.test/ws"},
+		{from: "ws://example.com/", location: "//other.test/ws", want: "ws://other.test/ws"},
+		{from: "wss://example.com/", location: "ws://example.com/ws", wantErr: true},
+		{from: "wss://example.com/", location: "//other.test/ws", want: "wss://other.test/ws"},
+		{from: "ws://example.com/", location: "", wantErr: true},
+		{from: "ws://example.com/", location: "http://[::1", wantErr: true},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{StatusCode: http.StatusFound, Header: http.Header{}}
+		if tt.location != "" {
+			resp.Header.Set("Location", tt.location)
+		}
+		got, err := redirectLocation(tt.from, resp)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("redirectLocation(%q, %q) = %q, want an error", tt.from, tt.location, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("redirectLocation(%q, %q) = %q, %v, want %q", tt.from, tt.location, got, err, tt.want)
+		}
+	}
+}